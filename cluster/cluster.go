@@ -1,16 +1,24 @@
 package cluster
 
 import (
+	"bytes"
 	"container-network/containerd"
 	"container-network/fn"
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"gopkg.in/yaml.v2"
@@ -19,12 +27,47 @@ import (
 var Instance *Cluster = New()
 
 func New() *Cluster {
-	return &Cluster{}
+	return &Cluster{router: httprouter.New(), local: httprouter.New(), loaded: make(chan struct{}), joined: map[string]bool{}}
 }
 
 type Cluster struct {
 	Current *Node   `yaml:"current"`
 	Nodes   []*Node `yaml:"nodes"`
+	// Pool is the address space the nodes without a container CIDR claim
+	// their block from.
+	Pool *Pool `yaml:"pool"`
+	// Token lets a node that is not in the config join the cluster, see
+	// Join. Joining is disabled without one.
+	Token  string `yaml:"token"`
+	router *httprouter.Router
+	// local serves the endpoints that change the node on fn.APISocket.
+	local  *httprouter.Router
+	loaded chan struct{}
+	// members holds the nodes that joined, or that were learned on joining,
+	// keyed by node IP. They are persisted at membersPath.
+	members     map[string]*Node
+	membersPath string
+	// joined holds the peers that accepted the node as a member, keyed by
+	// node IP.
+	joined map[string]bool
+	sync.Mutex
+}
+
+// Loaded is closed once the config is read.
+func (c *Cluster) Loaded() <-chan struct{} {
+	return c.loaded
+}
+
+// Handle registers an API endpoint served next to the cluster endpoints.
+// It must be called before Running.
+func (c *Cluster) Handle(method string, path string, handle httprouter.Handle) {
+	c.router.Handle(method, path, handle)
+}
+
+// HandleLocal registers an API endpoint served on the local socket only, for
+// endpoints that change the node. It must be called before Running.
+func (c *Cluster) HandleLocal(method string, path string, handle httprouter.Handle) {
+	c.local.Handle(method, path, handle)
 }
 
 func (c *Cluster) init() error {
@@ -39,22 +82,54 @@ func (c *Cluster) init() error {
 	if err := yaml.Unmarshal(data, c); err != nil {
 		return err
 	}
-	return nil
+	if c.Pool != nil && c.Pool.NodeSize == 0 {
+		c.Pool.NodeSize = DefaultNodeSize
+	}
+	for _, node := range append([]*Node{c.Current}, c.Nodes...) {
+		if err := node.validate(); err != nil {
+			return fmt.Errorf("invalid config. node: %v. error: %v", node.IP, err)
+		}
+	}
+	return c.loadMembers()
 }
 
 func (c *Cluster) Running(ctx context.Context) {
 	if err := c.init(); err != nil {
 		panic(err)
 	}
+	close(c.loaded)
 
-	router := httprouter.New()
+	router := c.router
+	router.POST("/cluster/join", c.handleJoin)
+	router.GET("/cluster/nodes", c.listNodes)
 	router.GET("/vxlan/mac", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		if len(c.Current.VXLAN.MAC) == 0 {
+		network := c.Current.Network(r.URL.Query().Get("network"))
+		if network == nil || network.VXLAN == nil {
+			http.Error(w, "unknown network", http.StatusNotFound)
+			return
+		}
+		if len(network.VXLAN.MAC) == 0 {
+			http.Error(w, "not ready", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, string(network.VXLAN.MAC))
+	})
+	router.GET("/geneve/mac", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if c.Current.GENEVE == nil || len(c.Current.GENEVE.MAC) == 0 {
+			http.Error(w, "not ready", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, c.Current.GENEVE.MAC)
+	})
+	router.GET("/wireguard/publickey", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if c.Current.WireGuard == nil || len(c.Current.WireGuard.PublicKey) == 0 {
 			http.Error(w, "not ready", http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, string(c.Current.VXLAN.MAC))
+		io.WriteString(w, c.Current.WireGuard.PublicKey)
 	})
 	router.GET("/containers", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		containers := []*containerd.Container{}
@@ -70,44 +145,152 @@ func (c *Cluster) Running(ctx context.Context) {
 		io.WriteString(w, string(bys))
 	})
 
+	go c.serveLocal()
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("%v:8080", c.Current.IP), router))
 }
 
-func (c *Cluster) GetVXLANMAC(ctx context.Context, nodeIP string) (string, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+// serveLocal serves the local endpoints on a unix socket only root can
+// connect to. --api-socket=<path> overrides fn.APISocket.
+func (c *Cluster) serveLocal() {
+	socket := fn.Args("api-socket")
+	if len(socket) == 0 {
+		socket = fn.APISocket
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
 	}
-	api := fmt.Sprintf("http://%v/vxlan/mac", fmt.Sprintf("%v:8080", nodeIP))
-	req, err := http.NewRequest("GET", api, nil)
+	listener, err := net.Listen("unix", socket)
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-	resp, err := client.Do(req)
+	if err := os.Chmod(socket, 0o600); err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.Serve(listener, c.local))
+}
+
+func (c *Cluster) GetVXLANMAC(ctx context.Context, nodeIP string, network string) (string, error) {
+	bysBody, err := c.get(ctx, nodeIP, "/vxlan/mac?network="+url.QueryEscape(network))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to get vxlan mac: %v", err)
 	}
-	bysBody, err := io.ReadAll(resp.Body)
+	return string(bysBody), nil
+}
+
+func (c *Cluster) GetGENEVEMAC(ctx context.Context, nodeIP string) (string, error) {
+	bysBody, err := c.get(ctx, nodeIP, "/geneve/mac")
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to get geneve mac: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to get vxlan mac: msg: %v. statusCode: %v", string(bysBody), resp.StatusCode)
+	return string(bysBody), nil
+}
+
+func (c *Cluster) GetWireGuardPublicKey(ctx context.Context, nodeIP string) (string, error) {
+	bysBody, err := c.get(ctx, nodeIP, "/wireguard/publickey")
+	if err != nil {
+		return "", fmt.Errorf("failed to get wireguard public key: %v", err)
 	}
 	return string(bysBody), nil
 }
 
 func (c *Cluster) GetContainers(ctx context.Context, nodeIP string) ([]*containerd.Container, error) {
+	bysBody, err := c.get(ctx, nodeIP, "/containers")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get containers: %v", err)
+	}
+	containers := []*containerd.Container{}
+	if err := json.Unmarshal(bysBody, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// GetBlocks returns the blocks the node knows of, its own included.
+func (c *Cluster) GetBlocks(ctx context.Context, nodeIP string) ([]*Block, error) {
+	bysBody, err := c.get(ctx, nodeIP, "/ipam/blocks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blocks: %v", err)
+	}
+	blocks := []*Block{}
+	if err := json.Unmarshal(bysBody, &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// ClaimBlock proposes block to the node. It reports false if the node knows
+// the block, or an overlapping one, as another node's, or as proposed by
+// another node. The node only records the block once it is committed.
+func (c *Cluster) ClaimBlock(ctx context.Context, nodeIP string, block *Block) (bool, error) {
+	return c.postBlock(ctx, nodeIP, "/ipam/blocks", block)
+}
+
+// CommitBlock tells the node that the block it accepted was accepted by a
+// quorum, so it records it.
+func (c *Cluster) CommitBlock(ctx context.Context, nodeIP string, block *Block) (bool, error) {
+	return c.postBlock(ctx, nodeIP, "/ipam/blocks/commit", block)
+}
+
+func (c *Cluster) postBlock(ctx context.Context, nodeIP string, path string, block *Block) (bool, error) {
+	body, err := json.Marshal(block)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.do(ctx, "POST", nodeIP, path, bytes.NewReader(body))
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to claim block: %v", err)
+	}
+	return true, nil
+}
+
+// Peer returns the node a request on the cluster address comes from, or nil
+// if it does not come from a node of the config or a member.
+func (c *Cluster) Peer(r *http.Request) *Node {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	for _, node := range c.Peers() {
+		if ip != nil && ip.Equal(net.ParseIP(node.IP)) {
+			return node
+		}
+	}
+	return nil
+}
+
+// StatusError is returned for a response of a node that is not 200.
+type StatusError struct {
+	Msg        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("msg: %v. statusCode: %v", e.Msg, e.StatusCode)
+}
+
+func (c *Cluster) get(ctx context.Context, nodeIP string, path string) ([]byte, error) {
+	return c.do(ctx, "GET", nodeIP, path, nil)
+}
+
+func (c *Cluster) do(ctx context.Context, method string, nodeIP string, path string, body io.Reader) ([]byte, error) {
+	// Requests leave from the node IP, which is how peers tell nodes apart,
+	// see Peer.
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(c.Current.IP)}}
 	client := &http.Client{
 		Transport: &http.Transport{
+			DialContext:     dialer.DialContext,
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		},
 	}
-	api := fmt.Sprintf("http://%v/containers", fmt.Sprintf("%v:8080", nodeIP))
-
-	req, err := http.NewRequest("GET", api, nil)
+	api := fmt.Sprintf("http://%v%v", fmt.Sprintf("%v:8080", nodeIP), path)
+	req, err := http.NewRequestWithContext(ctx, method, api, body)
 	if err != nil {
 		return nil, err
 	}
@@ -115,19 +298,15 @@ func (c *Cluster) GetContainers(ctx context.Context, nodeIP string) ([]*containe
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	bysBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get containers: msg: %v. statusCode: %v", string(bysBody), resp.StatusCode)
-	}
-	containers := []*containerd.Container{}
-	if err := json.Unmarshal(bysBody, &containers); err != nil {
-		return nil, err
+		return nil, &StatusError{Msg: string(bysBody), StatusCode: resp.StatusCode}
 	}
-	return containers, nil
+	return bysBody, nil
 }
 
 // func (c *Cluster) GetContainers(ctx context.Context) (map[string][]*containerd.Container, error) {
@@ -169,15 +348,168 @@ type Node struct {
 	Interface string     `yaml:"interface"`
 	IP        string     `yaml:"ip"`
 	VXLAN     *VXLAN     `yaml:"vxlan"`
+	GENEVE    *GENEVE    `yaml:"geneve"`
+	WireGuard *WireGuard `yaml:"wireguard"`
+	BGP       *BGP       `yaml:"bgp"`
 	Container *Container `yaml:"container"`
+	// Networks are isolated networks next to the default one made of
+	// Container and VXLAN, each with its own VNI and bridge.
+	Networks []*Network `yaml:"networks"`
+}
+
+const DefaultNetwork = "default"
+
+// DefaultNetwork returns the network made of the node's Container and VXLAN.
+func (n *Node) DefaultNetwork() *Network {
+	return &Network{Name: DefaultNetwork, VNI: 100, Bridge: "br0", Container: n.Container, VXLAN: n.VXLAN}
+}
+
+// validate checks that the named networks are isolated from each other and
+// from the default network: each needs its own name, VNI and bridge, and a
+// container CIDR. Two networks on one VNI would share a vxlan device and so
+// one L2 domain.
+func (n *Node) validate() error {
+	def := n.DefaultNetwork()
+	names := map[string]bool{def.Name: true}
+	vnis := map[int]string{def.VNI: def.Name}
+	bridges := map[string]string{def.Bridge: def.Name}
+	for _, network := range n.Networks {
+		switch {
+		case len(network.Name) == 0:
+			return fmt.Errorf("network without a name")
+		case names[network.Name]:
+			return fmt.Errorf("network %v is defined twice or reserved", network.Name)
+		case network.VNI <= 0 || network.VNI >= 1<<24:
+			return fmt.Errorf("invalid vni %v. network: %v", network.VNI, network.Name)
+		case len(vnis[network.VNI]) > 0:
+			return fmt.Errorf("vni %v of network %v is used by network %v", network.VNI, network.Name, vnis[network.VNI])
+		case len(network.Bridge) == 0 || len(network.Bridge) > 15:
+			return fmt.Errorf("invalid bridge %q. network: %v", network.Bridge, network.Name)
+		case len(bridges[network.Bridge]) > 0:
+			return fmt.Errorf("bridge %v of network %v is used by network %v", network.Bridge, network.Name, bridges[network.Bridge])
+		case network.Container == nil || (len(network.Container.CIDR) == 0 && len(network.Container.CIDR6) == 0):
+			return fmt.Errorf("network %v has no container cidr", network.Name)
+		}
+		names[network.Name] = true
+		vnis[network.VNI] = network.Name
+		bridges[network.Bridge] = network.Name
+	}
+	return nil
+}
+
+// AllNetworks returns the default network followed by the named networks.
+func (n *Node) AllNetworks() []*Network {
+	return append([]*Network{n.DefaultNetwork()}, n.Networks...)
+}
+
+// Network returns the network with the given name, or nil if the node does not have it.
+func (n *Node) Network(name string) *Network {
+	if len(name) == 0 || name == DefaultNetwork {
+		return n.DefaultNetwork()
+	}
+	for _, network := range n.Networks {
+		if network.Name == name {
+			return network
+		}
+	}
+	return nil
+}
+
+// NetworkOf returns the network whose container patterns match the container
+// name, or the default network.
+func (n *Node) NetworkOf(containerName string) *Network {
+	for _, network := range n.Networks {
+		for _, pattern := range network.Containers {
+			if matched, _ := path.Match(pattern, containerName); matched {
+				return network
+			}
+		}
+	}
+	return n.DefaultNetwork()
+}
+
+type Network struct {
+	Name   string `yaml:"name"`
+	VNI    int    `yaml:"vni"`
+	Bridge string `yaml:"bridge"`
+	// Containers are the name patterns of the containers attached to the network.
+	Containers []string `yaml:"containers"`
+	// Allow are the networks that may reach this one.
+	Allow     []string   `yaml:"allow"`
+	Container *Container `yaml:"container"`
+	VXLAN     *VXLAN     `yaml:"vxlan"`
 }
 
 type Container struct {
 	CIDR    string `yaml:"cidr"`
 	Gateway string `yaml:"gateway"`
+	// CIDR6 and Gateway6 enable IPv6, alone or next to CIDR and Gateway.
+	CIDR6    string `yaml:"cidr6"`
+	Gateway6 string `yaml:"gateway6"`
+	// Attachment is how containers are plugged into the host: bridge (default),
+	// macvlan or ipvlan. AttachmentMode is the macvlan (bridge) or ipvlan (l2, l3) mode.
+	Attachment     string `yaml:"attachment"`
+	AttachmentMode string `yaml:"attachmentMode"`
+	// Reservations pin the addresses of some containers of the network.
+	Reservations []*Reservation `yaml:"reservations"`
+}
+
+// Reservation gives the containers whose name matches Container, a name or a
+// path.Match pattern, the fixed addresses IP and IP6 of the network. No other
+// container ever gets them. Network is only set on reservations made through
+// the API, in the config it is the enclosing network.
+type Reservation struct {
+	Container string `yaml:"container" json:"container"`
+	Network   string `yaml:"-" json:"network,omitempty"`
+	IP        string `yaml:"ip" json:"ip,omitempty"`
+	IP6       string `yaml:"ip6" json:"ip6,omitempty"`
+}
+
+// Pool is carved into blocks of NodeSize, e.g. /24s of 10.244.0.0/16. A node
+// without a container CIDR claims the first free block from its peers, and
+// peers without one in the config learn theirs through the API.
+// NodeSize defaults to DefaultNodeSize.
+type Pool struct {
+	CIDR     string `yaml:"cidr"`
+	NodeSize int    `yaml:"nodeSize"`
+}
+
+const DefaultNodeSize = 24
+
+// Block is the container CIDR a node claimed from the pool.
+type Block struct {
+	CIDR    string    `json:"cidr"`
+	Node    string    `json:"node"`
+	Claimed time.Time `json:"claimed"`
 }
 
 type VXLAN struct {
 	IP  string `yaml:"ip"`
 	MAC string `yaml:"mac"`
 }
+
+type GENEVE struct {
+	VNI     int    `yaml:"vni"`
+	DstPort int    `yaml:"dstport"`
+	TTL     int    `yaml:"ttl"`
+	MAC     string `yaml:"mac"`
+}
+
+type WireGuard struct {
+	ListenPort int    `yaml:"listenPort"`
+	PublicKey  string `yaml:"publicKey"`
+}
+
+type BGP struct {
+	ASN        uint32 `yaml:"asn"`
+	RouterID   string `yaml:"routerId"`
+	ListenPort int32  `yaml:"listenPort"`
+	// Containers also announces a /32 for every local container.
+	Containers bool       `yaml:"containers"`
+	Peers      []*BGPPeer `yaml:"peers"`
+}
+
+type BGPPeer struct {
+	Address string `yaml:"address"`
+	ASN     uint32 `yaml:"asn"`
+}
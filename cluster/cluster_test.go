@@ -0,0 +1,81 @@
+package cluster
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	network := func(name string, vni int, bridge string) *Network {
+		return &Network{Name: name, VNI: vni, Bridge: bridge, Container: &Container{CIDR: "172.19.10.0/24"}}
+	}
+	tests := []struct {
+		name     string
+		networks []*Network
+		wantErr  bool
+	}{
+		{
+			name:     "isolated networks",
+			networks: []*Network{network("team-a", 200, "br-team-a"), network("team-b", 201, "br-team-b")},
+		},
+		{
+			name:     "IPv6 only",
+			networks: []*Network{{Name: "team-a", VNI: 200, Bridge: "br-team-a", Container: &Container{CIDR6: "fd00:172:19:10::/64"}}},
+		},
+		{
+			name:     "duplicate name",
+			networks: []*Network{network("team-a", 200, "br-team-a"), network("team-a", 201, "br-team-b")},
+			wantErr:  true,
+		},
+		{
+			name:     "reserved name",
+			networks: []*Network{network(DefaultNetwork, 200, "br-team-a")},
+			wantErr:  true,
+		},
+		{
+			name:     "missing name",
+			networks: []*Network{network("", 200, "br-team-a")},
+			wantErr:  true,
+		},
+		{
+			name:     "missing bridge",
+			networks: []*Network{network("team-a", 200, "")},
+			wantErr:  true,
+		},
+		{
+			name:     "default bridge",
+			networks: []*Network{network("team-a", 200, "br0")},
+			wantErr:  true,
+		},
+		{
+			name:     "shared bridge",
+			networks: []*Network{network("team-a", 200, "br-team"), network("team-b", 201, "br-team")},
+			wantErr:  true,
+		},
+		{
+			name:     "VNI 0",
+			networks: []*Network{network("team-a", 0, "br-team-a")},
+			wantErr:  true,
+		},
+		{
+			name:     "default VNI",
+			networks: []*Network{network("team-a", 100, "br-team-a")},
+			wantErr:  true,
+		},
+		{
+			name:     "shared VNI",
+			networks: []*Network{network("team-a", 200, "br-team-a"), network("team-b", 200, "br-team-b")},
+			wantErr:  true,
+		},
+		{
+			name:     "missing container CIDR",
+			networks: []*Network{{Name: "team-a", VNI: 200, Bridge: "br-team-a"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &Node{IP: "192.168.245.168", Networks: tt.networks}
+			if err := node.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package cluster
+
+import (
+	"bytes"
+	"container-network/fn"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// joinRequest is the body of POST /cluster/join.
+type joinRequest struct {
+	Token string `json:"token"`
+	Node  *Node  `json:"node"`
+}
+
+// Peers returns the nodes of the config followed by the members, the nodes
+// that joined the cluster or were learned when joining it, sorted by IP.
+func (c *Cluster) Peers() []*Node {
+	c.Lock()
+	defer c.Unlock()
+	return c.peers()
+}
+
+func (c *Cluster) peers() []*Node {
+	return append(append([]*Node{}, c.Nodes...), c.sortedMembers()...)
+}
+
+func (c *Cluster) sortedMembers() []*Node {
+	members := make([]*Node, 0, len(c.members))
+	for _, node := range c.members {
+		members = append(members, node)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].IP < members[j].IP })
+	return members
+}
+
+// loadMembers reads the members persisted at path. A dry run changes
+// nothing, so it keeps its members in memory only and gets "".
+func (c *Cluster) loadMembers() error {
+	c.members = map[string]*Node{}
+	if !fn.Flag("dry-run") {
+		c.membersPath = filepath.Join(fn.StateDir, "members.json")
+	}
+	if len(c.membersPath) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(c.membersPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	members := []*Node{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return fmt.Errorf("failed to parse %v: %v", c.membersPath, err)
+	}
+	for _, node := range members {
+		if !c.isConfigured(node.IP) {
+			c.members[node.IP] = node
+		}
+	}
+	return nil
+}
+
+// isConfigured reports whether ip is the node itself or a node of the config.
+func (c *Cluster) isConfigured(ip string) bool {
+	if ip == c.Current.IP {
+		return true
+	}
+	for _, node := range c.Nodes {
+		if node.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// addMember records the node as a member, replacing the one with the same
+// IP, and reports whether the node was not known before. The node itself and
+// the nodes of the config are left as they are.
+func (c *Cluster) addMember(node *Node) (bool, error) {
+	if node == nil || net.ParseIP(node.IP) == nil {
+		return false, fmt.Errorf("invalid node")
+	}
+	if err := node.validate(); err != nil {
+		return false, fmt.Errorf("invalid node. node: %v. error: %v", node.IP, err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.isConfigured(node.IP) {
+		return false, nil
+	}
+	old, known := c.members[node.IP]
+	c.members[node.IP] = node
+	if err := c.saveMembers(); err != nil {
+		if known {
+			c.members[node.IP] = old
+		} else {
+			delete(c.members, node.IP)
+		}
+		return false, fmt.Errorf("failed to save member. node: %v. error: %v", node.IP, err)
+	}
+	if !known {
+		fn.Infof("node %v is a member", node.IP)
+	}
+	return !known, nil
+}
+
+func (c *Cluster) saveMembers() error {
+	if len(c.membersPath) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.sortedMembers(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fn.WriteFileAtomic(c.membersPath, data)
+}
+
+// nodes returns the node itself and its peers, but the node with the IP
+// except.
+func (c *Cluster) nodes(except string) []*Node {
+	nodes := []*Node{}
+	for _, node := range append([]*Node{c.Current}, c.Peers()...) {
+		if node.IP != except {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// handleJoin lets a node that knows the token of the cluster join it. The
+// node is recorded as a member, so it is handed to the driver and may claim
+// a block, and gets the nodes this node knows of in return. A node can only
+// join as itself.
+func (c *Cluster) handleJoin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if len(c.Token) == 0 {
+		http.Error(w, "joining is disabled", http.StatusForbidden)
+		return
+	}
+	req := &joinRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(c.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || req.Node == nil || !net.ParseIP(host).Equal(net.ParseIP(req.Node.IP)) {
+		http.Error(w, "a node may only join as itself", http.StatusForbidden)
+		return
+	}
+	if _, err := c.addMember(req.Node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.listNodes(w, r, p)
+}
+
+// listNodes returns the node itself and its peers, but the one asking.
+func (c *Cluster) listNodes(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	bys, err := json.Marshal(c.nodes(host))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// Join makes the node a member of every peer that has not accepted it yet,
+// and records the nodes the peers know of, which it joins in turn. So a new
+// node only needs one node of the cluster and the token in its config, and
+// no other node's config changes. A dry run only learns the nodes, so the
+// peers record nothing. Join is a no-op without a token. It is only called
+// from the loop of network.Mgr.
+func (c *Cluster) Join(ctx context.Context) {
+	if len(c.Token) == 0 {
+		return
+	}
+	for {
+		learned := false
+		for _, node := range c.Peers() {
+			if c.joined[node.IP] {
+				continue
+			}
+			nodes, err := c.join(ctx, node.IP)
+			if err != nil {
+				fn.Errorf("failed to join. node: %v. error: %v", node.IP, err)
+				continue
+			}
+			c.joined[node.IP] = true
+			for _, n := range nodes {
+				added, err := c.addMember(n)
+				if err != nil {
+					fn.Errorf("failed to learn node. node: %v. error: %v", node.IP, err)
+				}
+				learned = learned || added
+			}
+		}
+		if !learned {
+			return
+		}
+	}
+}
+
+func (c *Cluster) join(ctx context.Context, nodeIP string) ([]*Node, error) {
+	var bysBody []byte
+	var err error
+	if fn.Flag("dry-run") {
+		bysBody, err = c.get(ctx, nodeIP, "/cluster/nodes")
+	} else {
+		body, jerr := json.Marshal(&joinRequest{Token: c.Token, Node: c.Current})
+		if jerr != nil {
+			return nil, jerr
+		}
+		bysBody, err = c.do(ctx, "POST", nodeIP, "/cluster/join", bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*Node{}
+	if err := json.Unmarshal(bysBody, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testCluster(token string) *Cluster {
+	c := New()
+	c.Token = token
+	c.Current = &Node{IP: "192.168.245.168"}
+	c.Nodes = []*Node{{IP: "192.168.245.172"}}
+	c.members = map[string]*Node{}
+	return c
+}
+
+func TestHandleJoin(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		req        *joinRequest
+		remote     string
+		wantStatus int
+		wantPeers  int
+	}{
+		{
+			name:       "member",
+			token:      "s3cret",
+			req:        &joinRequest{Token: "s3cret", Node: &Node{IP: "192.168.245.180"}},
+			remote:     "192.168.245.180:40000",
+			wantStatus: http.StatusOK,
+			wantPeers:  2,
+		},
+		{
+			name:       "node of the config",
+			token:      "s3cret",
+			req:        &joinRequest{Token: "s3cret", Node: &Node{IP: "192.168.245.172"}},
+			remote:     "192.168.245.172:40000",
+			wantStatus: http.StatusOK,
+			wantPeers:  1,
+		},
+		{
+			name:       "joining disabled",
+			req:        &joinRequest{Node: &Node{IP: "192.168.245.180"}},
+			remote:     "192.168.245.180:40000",
+			wantStatus: http.StatusForbidden,
+			wantPeers:  1,
+		},
+		{
+			name:       "invalid token",
+			token:      "s3cret",
+			req:        &joinRequest{Token: "guess", Node: &Node{IP: "192.168.245.180"}},
+			remote:     "192.168.245.180:40000",
+			wantStatus: http.StatusForbidden,
+			wantPeers:  1,
+		},
+		{
+			name:       "another node",
+			token:      "s3cret",
+			req:        &joinRequest{Token: "s3cret", Node: &Node{IP: "192.168.245.180"}},
+			remote:     "192.168.245.181:40000",
+			wantStatus: http.StatusForbidden,
+			wantPeers:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCluster(tt.token)
+			body, err := json.Marshal(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", "/cluster/join", bytes.NewReader(body))
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			c.handleJoin(w, r, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v. body: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := len(c.Peers()); got != tt.wantPeers {
+				t.Errorf("len(Peers()) = %v, want %v", got, tt.wantPeers)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			nodes := []*Node{}
+			if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil {
+				t.Fatal(err)
+			}
+			for _, node := range nodes {
+				if node.IP == tt.req.Node.IP {
+					t.Errorf("nodes returned to %v include itself", node.IP)
+				}
+			}
+		})
+	}
+}
+
+func TestPeer(t *testing.T) {
+	c := testCluster("s3cret")
+	c.members["192.168.245.180"] = &Node{IP: "192.168.245.180"}
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"192.168.245.172:40000", "192.168.245.172"},
+		{"192.168.245.180:40000", "192.168.245.180"},
+		{"192.168.245.181:40000", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/ipam/blocks", nil)
+		r.RemoteAddr = tt.remote
+		got := ""
+		if node := c.Peer(r); node != nil {
+			got = node.IP
+		}
+		if got != tt.want {
+			t.Errorf("Peer(%v) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"container-network/fn"
+	"container-network/network/cni"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// NetConf is the network configuration, e.g.
+//
+//	{"cniVersion": "1.0.0", "name": "container-network", "type": "container-network-cni"}
+type NetConf struct {
+	types.NetConf
+	// Socket is the local API socket of the daemon, fn.APISocket by default.
+	Socket string `json:"socket"`
+}
+
+func main() {
+	skel.PluginMainFuncs(skel.CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}, version.All, "container-network CNI plugin")
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	resp := &cni.Response{}
+	if err := call(conf, "/cni/add", args, resp); err != nil {
+		return err
+	}
+	result, err := newResult(args, resp)
+	if err != nil {
+		return err
+	}
+	return types.PrintResult(result, conf.CNIVersion)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return call(conf, "/cni/check", args, &cni.Response{})
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return call(conf, "/cni/del", args, nil)
+}
+
+func parseConf(data []byte) (*NetConf, error) {
+	conf := &NetConf{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if len(conf.Socket) == 0 {
+		conf.Socket = fn.APISocket
+	}
+	return conf, nil
+}
+
+func call(conf *NetConf, path string, args *skel.CmdArgs, out *cni.Response) error {
+	bys, err := json.Marshal(&cni.Request{ContainerID: args.ContainerID, Netns: args.Netns, IfName: args.IfName})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", conf.Socket)
+			},
+		},
+	}
+	resp, err := client.Post("http://localhost"+path, "application/json", bytes.NewReader(bys))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bysBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to call %v: msg: %s. statusCode: %v", path, bysBody, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(bysBody, out)
+}
+
+func newResult(args *skel.CmdArgs, resp *cni.Response) (*current.Result, error) {
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	if len(resp.HostInterface) > 0 {
+		result.Interfaces = append(result.Interfaces, &current.Interface{Name: resp.HostInterface})
+	}
+	result.Interfaces = append(result.Interfaces, &current.Interface{Name: resp.Interface, Sandbox: args.Netns})
+	index := len(result.Interfaces) - 1
+
+	for _, ip := range resp.IPs {
+		addr, ipNet, err := net.ParseCIDR(ip.Address)
+		if err != nil {
+			return nil, err
+		}
+		ipNet.IP = addr
+		result.IPs = append(result.IPs, &current.IPConfig{Interface: &index, Address: *ipNet, Gateway: net.ParseIP(ip.Gateway)})
+
+		dst := "0.0.0.0/0"
+		if addr.To4() == nil {
+			dst = "::/0"
+		}
+		_, defaultNet, _ := net.ParseCIDR(dst)
+		result.Routes = append(result.Routes, &types.Route{Dst: *defaultNet, GW: net.ParseIP(ip.Gateway)})
+	}
+	return result, nil
+}
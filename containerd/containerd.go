@@ -3,8 +3,13 @@ package containerd
 import (
 	"container-network/fn"
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 var Instance *Containerd = New()
@@ -26,20 +31,68 @@ func New() *Containerd {
 }
 
 type Containerd struct {
-	Containers map[string]*Container
+	Containers  map[string]*Container
+	subscribers []chan *Event
 	sync.Mutex
 }
 
+const (
+	Added   = "added"
+	Removed = "removed"
+)
+
+// Event reports that the netns of a container appeared in or disappeared
+// from fn.NetnsDir. Container is the registry entry of a removed container.
+type Event struct {
+	Type      string
+	Name      string
+	Container *Container
+}
+
+// Subscribe returns a channel receiving every event from now on. Events are
+// dropped when the subscriber falls behind, so subscribers must also resync
+// from List periodically.
+func (c *Containerd) Subscribe() <-chan *Event {
+	c.Lock()
+	defer c.Unlock()
+	ch := make(chan *Event, 256)
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+func (c *Containerd) publish(event *Event) {
+	c.Lock()
+	defer c.Unlock()
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- event:
+		default:
+			fn.Errorf("dropped container event, subscriber is full. event: %+v", event)
+		}
+	}
+}
+
 func (c *Containerd) Set(container *Container) {
 	c.Lock()
 	defer c.Unlock()
 	c.Containers[container.Name] = container
 }
 
+func (c *Containerd) Delete(name string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.Containers, name)
+}
+
+// List returns a snapshot of the containers, keyed by name.
 func (c *Containerd) List() map[string]*Container {
 	c.Lock()
 	defer c.Unlock()
-	return c.Containers
+	containers := make(map[string]*Container, len(c.Containers))
+	for name, container := range c.Containers {
+		containers[name] = container
+	}
+	return containers
 }
 
 func (c *Containerd) Get(name string) (*Container, bool) {
@@ -49,30 +102,102 @@ func (c *Containerd) Get(name string) (*Container, bool) {
 	return value, ok
 }
 
+// Running watches fn.NetnsDir and publishes an event for every netns created
+// or removed there. A slow resync catches anything the watch missed.
+// fn.NetnsDir is created first, as ip netns does, since on a fresh host it
+// only appears with the first netns.
 func (c *Containerd) Running(ctx context.Context) {
+	var events chan fsnotify.Event
+	var errors chan error
+	err := fn.Exec.Apply(fmt.Sprintf("mkdir -p %v", fn.NetnsDir), func() error {
+		return os.MkdirAll(fn.NetnsDir, 0o755)
+	})
+	var watcher *fsnotify.Watcher
+	if err == nil {
+		watcher, err = fsnotify.NewWatcher()
+	}
+	if err == nil {
+		err = watcher.Add(fn.NetnsDir)
+	}
+	if err != nil {
+		fn.Errorf("failed to watch %v, falling back to resync only: %s", fn.NetnsDir, err)
+	} else {
+		defer watcher.Close()
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Second * 5):
+		case event := <-events:
+			name := filepath.Base(event.Name)
+			switch {
+			case event.Has(fsnotify.Create):
+				c.add(name)
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				c.remove(name)
+			}
+		case err := <-errors:
+			fn.Errorf("failed to watch %v: %s", fn.NetnsDir, err)
+		case <-ticker.C:
 			names, err := fn.Containers()
 			if err != nil {
 				fn.Errorf("failed to get containers: %s", err)
+				continue
 			}
+			active := map[string]struct{}{}
 			for _, name := range names {
-				if _, ok := c.Containers[name]; !ok {
-					c.Containers[name] = &Container{Name: name}
+				active[name] = struct{}{}
+				c.add(name)
+			}
+			for name := range c.List() {
+				if _, ok := active[name]; !ok {
+					c.remove(name)
 				}
 			}
 		}
 	}
 }
 
+// add registers the container unless it is known, and publishes it.
+func (c *Containerd) add(name string) {
+	c.Lock()
+	_, ok := c.Containers[name]
+	if !ok {
+		c.Containers[name] = &Container{Name: name}
+	}
+	c.Unlock()
+	if !ok {
+		c.publish(&Event{Type: Added, Name: name})
+	}
+}
+
+// remove drops the container from the registry, which releases its
+// addresses, and publishes it so its links get torn down.
+func (c *Containerd) remove(name string) {
+	c.Lock()
+	container, ok := c.Containers[name]
+	delete(c.Containers, name)
+	c.Unlock()
+	if ok {
+		c.publish(&Event{Type: Removed, Name: name, Container: container})
+	}
+}
+
 type Container struct {
+	// ID is the runtime container ID of containers added through CNI.
+	ID    string
 	Name  string
 	IP    string
+	IP6   string
 	Veth0 string
 	Veth1 string
+	// Network is the name of the cluster network the container is attached to.
+	Network string
 	// ContainerPort string
 	// HostPort      string
 }
@@ -20,3 +20,13 @@ func Args(name string) (out string) {
 	}
 	return
 }
+
+// Flag reports whether the boolean flag is set, as --name or --name=true.
+func Flag(name string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == fmt.Sprintf("--%v", name) {
+			return true
+		}
+	}
+	return Args(name) == "true"
+}
@@ -5,13 +5,16 @@ import (
 	"sync"
 )
 
+// NetnsDir holds one bind mounted netns per container, named after the container.
+const NetnsDir = "/var/run/netns"
+
 var netnsLock = sync.Mutex{}
 
 func ActiveContailer() (map[string]struct{}, error) {
 	netnsLock.Lock()
 	defer netnsLock.Unlock()
 
-	files, err := os.ReadDir("/var/run/netns")
+	files, err := os.ReadDir(NetnsDir)
 	if err != nil {
 		return nil, err
 	}
@@ -26,9 +29,13 @@ func ActiveContailer() (map[string]struct{}, error) {
 	return activeContailer, nil
 }
 
+// Containers returns the names of the netns in NetnsDir. ip netns creates
+// the directory with the first netns, so a missing one holds no container.
 func Containers() ([]string, error) {
-	files, err := os.ReadDir("/var/run/netns")
-	if err != nil {
+	files, err := os.ReadDir(NetnsDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
 		return nil, err
 	}
 	containers := []string{}
@@ -0,0 +1,158 @@
+package fn
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Executor carries out every change the daemon makes to the host. Commands
+// that only read the host go through Query, so a dry run still sees the real
+// state and plans the same changes a real run would make.
+type Executor interface {
+	// Run runs a command that changes the host and returns its combined output.
+	Run(name string, args ...string) ([]byte, error)
+	// Query runs a command that only reads the host and returns its combined output.
+	Query(name string, args ...string) ([]byte, error)
+	// Apply makes an in-process change, such as a netlink request. desc is
+	// the equivalent command line, with its arguments quoted by Quote, or a
+	// "# " comment for a change no command makes.
+	Apply(desc string, apply func() error) error
+}
+
+// Exec is the executor used by the daemon. main replaces it before anything
+// touches the host.
+var Exec Executor = &RealExecutor{}
+
+// CommandLine returns the command as a shell would run it, every argument
+// quoted by Quote.
+func CommandLine(name string, args ...string) string {
+	quoted := []string{}
+	for _, arg := range append([]string{name}, args...) {
+		quoted = append(quoted, Quote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Quote returns s as one shell word. Words of safe characters only, such as
+// names, addresses and paths, are left as they are.
+func Quote(s string) string {
+	if len(s) > 0 && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RealExecutor changes the host.
+type RealExecutor struct{}
+
+func (e *RealExecutor) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (e *RealExecutor) Query(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (e *RealExecutor) Apply(desc string, apply func() error) error {
+	return apply()
+}
+
+// DryRunExecutor prints the changes it is asked to make instead of making
+// them. Queries still run, so the plan reflects the host.
+type DryRunExecutor struct {
+	w io.Writer
+}
+
+func NewDryRunExecutor(w io.Writer) *DryRunExecutor {
+	return &DryRunExecutor{w: w}
+}
+
+func (e *DryRunExecutor) Run(name string, args ...string) ([]byte, error) {
+	fmt.Fprintf(e.w, "\033[33m[dry-run]\033[0m %v\n", CommandLine(name, args...))
+	return nil, nil
+}
+
+func (e *DryRunExecutor) Query(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (e *DryRunExecutor) Apply(desc string, apply func() error) error {
+	fmt.Fprintf(e.w, "\033[33m[dry-run]\033[0m %v\n", desc)
+	return nil
+}
+
+// Record is one command seen by a RecordingExecutor.
+type Record struct {
+	Command string
+	Query   bool
+	Output  string
+	Err     string
+}
+
+// RecordingExecutor passes every command to next and keeps a transcript of
+// them with their outputs.
+type RecordingExecutor struct {
+	next    Executor
+	records []Record
+	sync.Mutex
+}
+
+func NewRecordingExecutor(next Executor) *RecordingExecutor {
+	return &RecordingExecutor{next: next}
+}
+
+func (e *RecordingExecutor) Run(name string, args ...string) ([]byte, error) {
+	cmdout, err := e.next.Run(name, args...)
+	e.record(CommandLine(name, args...), false, cmdout, err)
+	return cmdout, err
+}
+
+func (e *RecordingExecutor) Query(name string, args ...string) ([]byte, error) {
+	cmdout, err := e.next.Query(name, args...)
+	e.record(CommandLine(name, args...), true, cmdout, err)
+	return cmdout, err
+}
+
+func (e *RecordingExecutor) Apply(desc string, apply func() error) error {
+	err := e.next.Apply(desc, apply)
+	e.record(desc, false, nil, err)
+	return err
+}
+
+func (e *RecordingExecutor) record(command string, query bool, cmdout []byte, err error) {
+	e.Lock()
+	defer e.Unlock()
+	r := Record{Command: command, Query: query, Output: string(cmdout)}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	e.records = append(e.records, r)
+}
+
+// Records returns the commands seen so far, in order.
+func (e *RecordingExecutor) Records() []Record {
+	e.Lock()
+	defer e.Unlock()
+	return append([]Record{}, e.records...)
+}
+
+// WriteTranscript writes the commands as a shell script that replays the
+// changes. Queries are commented out and failures are annotated.
+func (e *RecordingExecutor) WriteTranscript(w io.Writer) error {
+	for _, r := range e.Records() {
+		line := r.Command
+		if r.Query {
+			line = "# " + strings.ReplaceAll(line, "\n", "\n# ")
+		}
+		if len(r.Err) > 0 {
+			line = fmt.Sprintf("%v # error: %v", line, strings.ReplaceAll(r.Err, "\n", " "))
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package fn
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{name: "safe", arg: "172.18.10.0/24", want: "172.18.10.0/24"},
+		{name: "empty", arg: "", want: "''"},
+		{name: "space", arg: "a b", want: "'a b'"},
+		{name: "quote", arg: "it's", want: `'it'\''s'`},
+		{name: "ruleset", arg: "table inet filter {\n\tchain forward { type filter hook forward priority 0; }\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Quote(tt.arg)
+			if len(tt.want) > 0 && got != tt.want {
+				t.Errorf("Quote(%q) = %v, want %v", tt.arg, got, tt.want)
+			}
+			// The shell has to hand the word back unchanged.
+			out, err := exec.Command("sh", "-c", "printf %s "+got).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.arg {
+				t.Errorf("sh read Quote(%q) as %q", tt.arg, out)
+			}
+		})
+	}
+}
+
+func TestWriteTranscript(t *testing.T) {
+	e := NewRecordingExecutor(NewDryRunExecutor(&bytes.Buffer{}))
+	e.Query("true", "table", "inet container-network")
+	e.Run("nft", "add table inet t\nadd chain inet t c")
+	e.Apply("# write a key", func() error { return nil })
+	e.Apply(CommandLine("ip", "link", "set", "br0", "up"), func() error { return nil })
+
+	w := &bytes.Buffer{}
+	if err := e.WriteTranscript(w); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# true table 'inet container-network'",
+		"nft 'add table inet t",
+		"add chain inet t c'",
+		"# write a key",
+		"ip link set br0 up",
+		"",
+	}, "\n")
+	if w.String() != want {
+		t.Errorf("WriteTranscript() = %q, want %q", w.String(), want)
+	}
+	if err := exec.Command("sh", "-n", "-c", w.String()).Run(); err != nil {
+		t.Errorf("transcript is not a valid script: %v", err)
+	}
+}
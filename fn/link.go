@@ -0,0 +1,15 @@
+package fn
+
+import (
+	"crypto/sha1"
+	"fmt"
+)
+
+// LinkName builds an interface name from prefix and name. Names over the
+// kernel limit of 15 bytes are shortened with a hash of name.
+func LinkName(prefix string, name string) string {
+	if len(prefix)+len(name) <= 15 {
+		return prefix + name
+	}
+	return prefix + fmt.Sprintf("%x", sha1.Sum([]byte(name)))[:15-len(prefix)]
+}
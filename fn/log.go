@@ -5,3 +5,7 @@ import "fmt"
 func Errorf(format string, a ...any) {
 	fmt.Printf("\033[31m[error]\033[0m "+format+"\n", a...)
 }
+
+func Infof(format string, a ...any) {
+	fmt.Printf("\033[32m[info]\033[0m "+format+"\n", a...)
+}
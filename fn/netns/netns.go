@@ -0,0 +1,51 @@
+// Package netns runs code inside the network namespaces under /var/run/netns
+// without forking ip netns exec.
+package netns
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// Do runs f on an OS thread switched into the named netns. The thread is
+// locked for the duration and switched back afterwards; if that fails, the
+// thread is thrown away instead of being returned to the scheduler.
+func Do(name string, f func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("failed to get current netns: %w", err)
+			return
+		}
+		defer origin.Close()
+
+		target, err := netns.GetFromName(name)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("netns %v: %w", name, err)
+			return
+		}
+		defer target.Close()
+
+		if err := netns.Set(target); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("failed to enter netns %v: %w", name, err)
+			return
+		}
+		err = f()
+		if restoreErr := netns.Set(origin); restoreErr != nil {
+			// Exiting the goroutine while locked terminates the thread.
+			errCh <- fmt.Errorf("failed to leave netns %v: %v", name, restoreErr)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- err
+	}()
+	return <-errCh
+}
@@ -0,0 +1,152 @@
+package nl
+
+import (
+	"container-network/fn"
+	"container-network/fn/netns"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Netns configures links, addresses and routes inside a named netns under
+// /var/run/netns, in-process through netns.Do.
+type Netns struct {
+	name string
+}
+
+func InNetns(name string) *Netns {
+	return &Netns{name: name}
+}
+
+// apply runs f inside the netns, described as ip netns exec <name> desc.
+func (n *Netns) apply(desc string, f func() error) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip netns exec %v %v", n.name, desc), func() error {
+		return netns.Do(n.name, f)
+	})
+}
+
+func (n *Netns) AddAddr(name string, addr string, nodad bool) error {
+	desc := fmt.Sprintf("ip addr add %v dev %v", addr, name)
+	if nodad {
+		desc += " nodad"
+	}
+	return n.apply(desc, func() error {
+		return addAddr(name, addr, nodad)
+	})
+}
+
+func (n *Netns) SetLinkUp(name string) error {
+	return n.apply(fmt.Sprintf("ip link set %v up", name), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+}
+
+func (n *Netns) SetLinkDown(name string) error {
+	return n.apply(fmt.Sprintf("ip link set %v down", name), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetDown(link)
+	})
+}
+
+func (n *Netns) SetLinkName(name string, newName string) error {
+	return n.apply(fmt.Sprintf("ip link set %v name %v", name, newName), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetName(link, newName)
+	})
+}
+
+func (n *Netns) AddRoute(r Route) error {
+	return n.apply("ip route add "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteAdd(route)
+	})
+}
+
+func (n *Netns) DelAddr(name string, addr string) error {
+	return n.apply(fmt.Sprintf("ip addr del %v dev %v", addr, name), func() error {
+		return delAddr(name, addr)
+	})
+}
+
+func (n *Netns) ReplaceRoute(r Route) error {
+	return n.apply("ip route replace "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteReplace(route)
+	})
+}
+
+func (n *Netns) DelRoute(r Route) error {
+	return n.apply("ip route del "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteDel(route)
+	})
+}
+
+// IsLinkUp, HasAddr, HasRoute and Addrs only read the netns, so they do not
+// go through fn.Exec.
+
+func (n *Netns) IsLinkUp(name string) (up bool, err error) {
+	err = netns.Do(n.name, func() error {
+		up, err = IsLinkUp(name)
+		return err
+	})
+	return up, err
+}
+
+func (n *Netns) HasAddr(name string, addr string) (ok bool, err error) {
+	err = netns.Do(n.name, func() error {
+		ok, err = hasAddr(name, addr)
+		return err
+	})
+	return ok, err
+}
+
+func (n *Netns) HasRoute(r Route) (ok bool, err error) {
+	err = netns.Do(n.name, func() error {
+		ok, err = hasRoute(r)
+		return err
+	})
+	return ok, err
+}
+
+// Addrs returns the global addresses of the link.
+func (n *Netns) Addrs(name string) ([]net.IP, error) {
+	ips := []net.IP{}
+	err := netns.Do(n.name, func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+				ips = append(ips, addr.IP)
+			}
+		}
+		return nil
+	})
+	return ips, err
+}
@@ -0,0 +1,467 @@
+// Package nl configures links, addresses, routes, neighbors, FDB entries and
+// sysctls of the host, and links, addresses and routes of container netns,
+// through netlink instead of ip, brctl, bridge and sysctl.
+// Errors keep the kernel errno, so callers test them with IsExist and
+// IsNotExist rather than by matching command output.
+//
+// Every change goes through fn.Exec, described by the equivalent command line.
+package nl
+
+import (
+	"container-network/fn"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// IsExist reports whether err means the object already exists.
+func IsExist(err error) bool {
+	return errors.Is(err, syscall.EEXIST)
+}
+
+// IsNotExist reports whether err means the object does not exist.
+func IsNotExist(err error) bool {
+	var notFound netlink.LinkNotFoundError
+	return errors.As(err, &notFound) ||
+		errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.ESRCH)
+}
+
+func linkByName(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("link %v: %w", name, err)
+	}
+	return link, nil
+}
+
+// LinkExists reports whether the link exists.
+func LinkExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
+// LinkMAC returns the hardware address of the link.
+func LinkMAC(name string) (string, error) {
+	link, err := linkByName(name)
+	if err != nil {
+		return "", err
+	}
+	if len(link.Attrs().HardwareAddr) == 0 {
+		return "", fmt.Errorf("link %v has no hardware address", name)
+	}
+	return link.Attrs().HardwareAddr.String(), nil
+}
+
+func AddBridge(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link add %v type bridge", name), func() error {
+		return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	})
+}
+
+func AddVeth(name string, peer string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link add %v type veth peer name %v", name, peer), func() error {
+		return netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: peer})
+	})
+}
+
+// AddSubInterface creates a macvlan or ipvlan link of parent in the given mode.
+func AddSubInterface(name string, parent string, kind string, mode string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link add %v link %v type %v mode %v", name, parent, kind, mode), func() error {
+		return addSubInterface(name, parent, kind, mode)
+	})
+}
+
+func addSubInterface(name string, parent string, kind string, mode string) error {
+	p, err := linkByName(parent)
+	if err != nil {
+		return err
+	}
+	attrs := netlink.LinkAttrs{Name: name, ParentIndex: p.Attrs().Index}
+	switch kind {
+	case "macvlan":
+		modes := map[string]netlink.MacvlanMode{
+			"private":  netlink.MACVLAN_MODE_PRIVATE,
+			"vepa":     netlink.MACVLAN_MODE_VEPA,
+			"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+			"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+			"source":   netlink.MACVLAN_MODE_SOURCE,
+		}
+		m, ok := modes[mode]
+		if !ok {
+			return fmt.Errorf("unknown macvlan mode: %q", mode)
+		}
+		return netlink.LinkAdd(&netlink.Macvlan{LinkAttrs: attrs, Mode: m})
+	case "ipvlan":
+		modes := map[string]netlink.IPVlanMode{
+			"l2":  netlink.IPVLAN_MODE_L2,
+			"l3":  netlink.IPVLAN_MODE_L3,
+			"l3s": netlink.IPVLAN_MODE_L3S,
+		}
+		m, ok := modes[mode]
+		if !ok {
+			return fmt.Errorf("unknown ipvlan mode: %q", mode)
+		}
+		return netlink.LinkAdd(&netlink.IPVlan{LinkAttrs: attrs, Mode: m})
+	}
+	return fmt.Errorf("unknown sub-interface kind: %q", kind)
+}
+
+// AddVXLAN creates a vxlan link on dev with learning disabled.
+func AddVXLAN(name string, vni int, local string, dev string, port int) error {
+	desc := fmt.Sprintf("ip link add %v type vxlan id %v local %v dev %v dstport %v nolearning", name, vni, local, dev, port)
+	return fn.Exec.Apply(desc, func() error {
+		d, err := linkByName(dev)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkAdd(&netlink.Vxlan{
+			LinkAttrs:    netlink.LinkAttrs{Name: name},
+			VxlanId:      vni,
+			VtepDevIndex: d.Attrs().Index,
+			SrcAddr:      net.ParseIP(local),
+			Port:         port,
+			Learning:     false,
+		})
+	})
+}
+
+// AddGENEVE creates a point-to-point geneve link to remote.
+func AddGENEVE(name string, mac string, vni int, remote string, port int, ttl int) error {
+	desc := fmt.Sprintf("ip link add %v address %v type geneve id %v remote %v dstport %v ttl %v", name, mac, vni, remote, port, ttl)
+	return fn.Exec.Apply(desc, func() error {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkAdd(&netlink.Geneve{
+			LinkAttrs: netlink.LinkAttrs{Name: name, HardwareAddr: hwAddr},
+			ID:        uint32(vni),
+			Remote:    net.ParseIP(remote),
+			Dport:     uint16(port),
+			Ttl:       uint8(ttl),
+		})
+	})
+}
+
+func AddIPIP(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link add %v type ipip", name), func() error {
+		return netlink.LinkAdd(&netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	})
+}
+
+func AddWireGuard(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link add %v type wireguard", name), func() error {
+		return netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}})
+	})
+}
+
+func DelLink(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link del %v", name), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkDel(link)
+	})
+}
+
+func SetLinkUp(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v up", name), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+}
+
+func SetLinkDown(name string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v down", name), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetDown(link)
+	})
+}
+
+func SetLinkMTU(name string, mtu int) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v mtu %v", name, mtu), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetMTU(link, mtu)
+	})
+}
+
+// SetLinkAlias sets the alias of the link, shown by ip link.
+func SetLinkAlias(name string, alias string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v alias %v", name, alias), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetAlias(link, alias)
+	})
+}
+
+// SetLinkMaster enslaves the link to master, e.g. a veth to a bridge.
+func SetLinkMaster(name string, master string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v master %v", name, master), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		m, err := linkByName(master)
+		if err != nil {
+			return err
+		}
+		if link.Attrs().MasterIndex == m.Attrs().Index {
+			return nil
+		}
+		return netlink.LinkSetMaster(link, m)
+	})
+}
+
+// SetLinkNetns moves the link into the named netns under /var/run/netns.
+func SetLinkNetns(name string, netnsName string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip link set %v netns %v", name, netnsName), func() error {
+		link, err := linkByName(name)
+		if err != nil {
+			return err
+		}
+		ns, err := netns.GetFromName(netnsName)
+		if err != nil {
+			return fmt.Errorf("netns %v: %w", netnsName, err)
+		}
+		defer ns.Close()
+		return netlink.LinkSetNsFd(link, int(ns))
+	})
+}
+
+// AddAddr adds addr to the link. Like ip addr add, an address without a
+// prefix length is a host address. nodad skips IPv6 duplicate address detection.
+func AddAddr(name string, addr string, nodad bool) error {
+	desc := fmt.Sprintf("ip addr add %v dev %v", addr, name)
+	if nodad {
+		desc += " nodad"
+	}
+	return fn.Exec.Apply(desc, func() error {
+		return addAddr(name, addr, nodad)
+	})
+}
+
+func addAddr(name string, addr string, nodad bool) error {
+	link, err := linkByName(name)
+	if err != nil {
+		return err
+	}
+	a, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if nodad {
+		a.Flags = syscall.IFA_F_NODAD
+	}
+	return netlink.AddrAdd(link, a)
+}
+
+func parseAddr(addr string) (*netlink.Addr, error) {
+	if !strings.Contains(addr, "/") {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			addr += "/128"
+		} else {
+			addr += "/32"
+		}
+	}
+	return netlink.ParseAddr(addr)
+}
+
+// Route is a unicast route. Dst is in CIDR notation, Via and Dev are optional.
+// Onlink makes Via reachable without a route to it.
+type Route struct {
+	Dst    string
+	Via    string
+	Dev    string
+	Onlink bool
+}
+
+func (r Route) netlink() (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(r.Dst)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{Dst: dst}
+	if len(r.Via) > 0 {
+		if route.Gw = net.ParseIP(r.Via); route.Gw == nil {
+			return nil, fmt.Errorf("invalid gateway: %v", r.Via)
+		}
+	}
+	if len(r.Dev) > 0 {
+		link, err := linkByName(r.Dev)
+		if err != nil {
+			return nil, err
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	if r.Onlink {
+		route.Flags = int(netlink.FLAG_ONLINK)
+	}
+	return route, nil
+}
+
+func (r Route) String() string {
+	s := r.Dst
+	if len(r.Via) > 0 {
+		s += " via " + r.Via
+	}
+	if len(r.Dev) > 0 {
+		s += " dev " + r.Dev
+	}
+	if r.Onlink {
+		s += " onlink"
+	}
+	return s
+}
+
+func AddRoute(r Route) error {
+	return fn.Exec.Apply("ip route add "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteAdd(route)
+	})
+}
+
+func ReplaceRoute(r Route) error {
+	return fn.Exec.Apply("ip route replace "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteReplace(route)
+	})
+}
+
+func DelRoute(r Route) error {
+	return fn.Exec.Apply("ip route del "+r.String(), func() error {
+		route, err := r.netlink()
+		if err != nil {
+			return err
+		}
+		return netlink.RouteDel(route)
+	})
+}
+
+func neigh(ip string, mac string, dev string) (*netlink.Neigh, error) {
+	link, err := linkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	n := &netlink.Neigh{LinkIndex: link.Attrs().Index, State: netlink.NUD_PERMANENT}
+	if n.IP = net.ParseIP(ip); n.IP == nil {
+		return nil, fmt.Errorf("invalid neighbor IP: %v", ip)
+	}
+	n.Family = netlink.FAMILY_V6
+	if n.IP.To4() != nil {
+		n.Family = netlink.FAMILY_V4
+	}
+	if len(mac) > 0 {
+		if n.HardwareAddr, err = net.ParseMAC(mac); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// AddNeigh adds a permanent neighbor entry mapping ip to mac on dev.
+func AddNeigh(ip string, mac string, dev string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip neigh add %v lladdr %v dev %v", ip, mac, dev), func() error {
+		n, err := neigh(ip, mac, dev)
+		if err != nil {
+			return err
+		}
+		return netlink.NeighAdd(n)
+	})
+}
+
+// ReplaceNeigh adds or updates a permanent neighbor entry mapping ip to mac on dev.
+func ReplaceNeigh(ip string, mac string, dev string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip neigh replace %v lladdr %v dev %v", ip, mac, dev), func() error {
+		n, err := neigh(ip, mac, dev)
+		if err != nil {
+			return err
+		}
+		return netlink.NeighSet(n)
+	})
+}
+
+func DelNeigh(ip string, dev string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip neigh del %v dev %v", ip, dev), func() error {
+		n, err := neigh(ip, "", dev)
+		if err != nil {
+			return err
+		}
+		return netlink.NeighDel(n)
+	})
+}
+
+func fdb(mac string, dev string, dst string) (*netlink.Neigh, error) {
+	link, err := linkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		Flags:        netlink.NTF_SELF,
+		State:        netlink.NUD_PERMANENT,
+		HardwareAddr: hwAddr,
+		IP:           net.ParseIP(dst),
+	}, nil
+}
+
+// AppendFDB adds a forwarding entry sending mac through dev to dst, next to
+// the existing entries for mac.
+func AppendFDB(mac string, dev string, dst string) error {
+	return fn.Exec.Apply(fmt.Sprintf("bridge fdb append %v dev %v dst %v", mac, dev, dst), func() error {
+		n, err := fdb(mac, dev, dst)
+		if err != nil {
+			return err
+		}
+		return netlink.NeighAppend(n)
+	})
+}
+
+func DelFDB(mac string, dev string, dst string) error {
+	return fn.Exec.Apply(fmt.Sprintf("bridge fdb del %v dev %v dst %v", mac, dev, dst), func() error {
+		n, err := fdb(mac, dev, dst)
+		if err != nil {
+			return err
+		}
+		return netlink.NeighDel(n)
+	})
+}
+
+// Sysctl writes value to the kernel parameter key, e.g. net.ipv4.conf.all.forwarding.
+func Sysctl(key string, value string) error {
+	return fn.Exec.Apply(fmt.Sprintf("sysctl -w %v=%v", key, value), func() error {
+		path := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		return os.WriteFile(path, []byte(value), 0644)
+	})
+}
@@ -0,0 +1,301 @@
+package nl
+
+import (
+	"container-network/fn"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The functions below only read the kernel state, so they do not go through
+// fn.Exec. A missing link reads as a missing object rather than an error.
+
+// IsLinkUp reports whether the link exists and is up.
+func IsLinkUp(name string) (bool, error) {
+	link, err := linkByName(name)
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return link.Attrs().Flags&net.FlagUp != 0, nil
+}
+
+// LinkMaster returns the name of the master of the link, or "" if it has none.
+func LinkMaster(name string) (string, error) {
+	link, err := linkByName(name)
+	if err != nil {
+		return "", err
+	}
+	if link.Attrs().MasterIndex == 0 {
+		return "", nil
+	}
+	master, err := netlink.LinkByIndex(link.Attrs().MasterIndex)
+	if err != nil {
+		return "", err
+	}
+	return master.Attrs().Name, nil
+}
+
+// LinkMTU returns the MTU of the link.
+func LinkMTU(name string) (int, error) {
+	link, err := linkByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+// LinkAlias returns the alias of the link, or "" if it has none.
+func LinkAlias(name string) (string, error) {
+	link, err := linkByName(name)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Alias, nil
+}
+
+func HasAddr(name string, addr string) (bool, error) {
+	return hasAddr(name, addr)
+}
+
+func hasAddr(name string, addr string) (bool, error) {
+	link, err := linkByName(name)
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	want, err := parseAddr(addr)
+	if err != nil {
+		return false, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == want.IPNet.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DelAddr removes addr from the link.
+func DelAddr(name string, addr string) error {
+	return fn.Exec.Apply(fmt.Sprintf("ip addr del %v dev %v", addr, name), func() error {
+		return delAddr(name, addr)
+	})
+}
+
+func delAddr(name string, addr string) error {
+	link, err := linkByName(name)
+	if err != nil {
+		return err
+	}
+	a, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrDel(link, a)
+	if err != nil && errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return fmt.Errorf("address %v: %w", addr, syscall.ENOENT)
+	}
+	return err
+}
+
+// HasRoute reports whether the main table has the route, with the same next
+// hop and device.
+func HasRoute(r Route) (bool, error) {
+	return hasRoute(r)
+}
+
+func hasRoute(r Route) (bool, error) {
+	want, err := r.netlink()
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	family := netlink.FAMILY_V4
+	if want.Dst.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteList(nil, family)
+	if err != nil {
+		return false, err
+	}
+	for _, route := range routes {
+		if !sameDst(route.Dst, want.Dst) || !route.Gw.Equal(want.Gw) {
+			continue
+		}
+		if want.LinkIndex != 0 && route.LinkIndex != want.LinkIndex {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// sameDst compares route destinations, where nil is the default route.
+func sameDst(a *net.IPNet, b *net.IPNet) bool {
+	ones := func(n *net.IPNet) int {
+		if n == nil {
+			return 0
+		}
+		ones, _ := n.Mask.Size()
+		return ones
+	}
+	if ones(a) == 0 && ones(b) == 0 {
+		return true
+	}
+	return a != nil && b != nil && a.String() == b.String()
+}
+
+// HasNeigh reports whether dev has a neighbor entry mapping ip to mac.
+func HasNeigh(ip string, mac string, dev string) (bool, error) {
+	want, err := neigh(ip, mac, dev)
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	neighs, err := netlink.NeighList(want.LinkIndex, want.Family)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(want.IP) && n.HardwareAddr.String() == want.HardwareAddr.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasFDB reports whether dev forwards mac to dst.
+func HasFDB(mac string, dev string, dst string) (bool, error) {
+	want, err := fdb(mac, dev, dst)
+	if IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	neighs, err := netlink.NeighList(want.LinkIndex, syscall.AF_BRIDGE)
+	if err != nil {
+		return false, err
+	}
+	for _, n := range neighs {
+		if n.HardwareAddr.String() == want.HardwareAddr.String() && n.IP.Equal(want.IP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadSysctl returns the value of the kernel parameter key.
+func ReadSysctl(key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/")))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// LinksByAlias returns the names of the links with the alias.
+func LinksByAlias(alias string) ([]string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, link := range links {
+		if link.Attrs().Alias == alias {
+			names = append(names, link.Attrs().Name)
+		}
+	}
+	return names, nil
+}
+
+// NeighEntry is a neighbor entry, see AddNeigh.
+type NeighEntry struct {
+	IP  string
+	MAC string
+}
+
+// Neighs returns the permanent neighbor entries of dev.
+func Neighs(dev string) ([]NeighEntry, error) {
+	link, err := linkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	entries := []NeighEntry{}
+	for _, n := range neighs {
+		if n.State&netlink.NUD_PERMANENT == 0 || n.IP == nil {
+			continue
+		}
+		entries = append(entries, NeighEntry{IP: n.IP.String(), MAC: n.HardwareAddr.String()})
+	}
+	return entries, nil
+}
+
+// FDBEntry is a forwarding entry of a vxlan device, see AppendFDB.
+type FDBEntry struct {
+	MAC string
+	Dst string
+}
+
+// FDBs returns the permanent forwarding entries of dev that point at a remote.
+func FDBs(dev string) ([]FDBEntry, error) {
+	link, err := linkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	entries := []FDBEntry{}
+	for _, n := range neighs {
+		if n.State&netlink.NUD_PERMANENT == 0 || n.IP == nil {
+			continue
+		}
+		entries = append(entries, FDBEntry{MAC: n.HardwareAddr.String(), Dst: n.IP.String()})
+	}
+	return entries, nil
+}
+
+// Routes returns the routes of the main table through dev that were added,
+// leaving out the ones the kernel adds for addresses.
+func Routes(dev string) ([]Route, error) {
+	link, err := linkByName(dev)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	result := []Route{}
+	for _, route := range routes {
+		if route.Protocol == syscall.RTPROT_KERNEL || route.Dst == nil {
+			continue
+		}
+		r := Route{Dst: route.Dst.String(), Dev: dev, Onlink: route.Flags&int(netlink.FLAG_ONLINK) != 0}
+		if route.Gw != nil {
+			r.Via = route.Gw.String()
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package fn
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// StateDir holds what the daemon has to remember across restarts.
+const StateDir = "/var/lib/container-network"
+
+// APISocket serves the endpoints that change the node, such as the ones of
+// the CNI plugin. Only root can reach it.
+const APISocket = "/run/container-network/api.sock"
+
+// WriteFileAtomic writes data to path through a temporary file in the same
+// directory, so path holds either the old or the new data after a crash.
+func WriteFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"container-network/cluster"
 	"container-network/containerd"
+	"container-network/fn"
 	"container-network/network"
 	"context"
 	"os"
@@ -11,16 +12,57 @@ import (
 )
 
 func main() {
+	// --dry-run prints the changes to the host instead of making them.
+	if fn.Flag("dry-run") {
+		fn.Exec = fn.NewDryRunExecutor(os.Stdout)
+	}
+	// --record=<path> writes the changes made to the host to path on exit.
+	var recorder *fn.RecordingExecutor
+	if recordPath := fn.Args("record"); len(recordPath) > 0 {
+		recorder = fn.NewRecordingExecutor(fn.Exec)
+		fn.Exec = recorder
+		defer writeTranscript(recorder, recordPath)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// network.New registers its API endpoints, so it must run before the cluster serves them.
+	mgr := network.New()
+
 	go cluster.Instance.Running(ctx)
 
 	go containerd.Instance.Running(ctx)
 
-	go network.New().Running(ctx)
+	done := make(chan struct{})
+	go func() {
+		mgr.Running(ctx)
+		close(done)
+	}()
 
 	sign := make(chan os.Signal, 1)
 	signal.Notify(sign, syscall.SIGINT, syscall.SIGTERM)
 	<-sign
 	cancel()
+	<-done
+
+	// --keep-datapath-on-exit leaves the host configured, so containers keep
+	// their connectivity across a restart.
+	if fn.Flag("keep-datapath-on-exit") {
+		return
+	}
+	if err := mgr.Cleanup(); err != nil {
+		fn.Errorf("failed to clean up. error: %v", err)
+	}
+}
+
+func writeTranscript(recorder *fn.RecordingExecutor, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		fn.Errorf("failed to create transcript. path: %v. error: %v", path, err)
+		return
+	}
+	defer f.Close()
+	if err := recorder.WriteTranscript(f); err != nil {
+		fn.Errorf("failed to write transcript. path: %v. error: %v", path, err)
+	}
 }
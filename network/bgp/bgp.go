@@ -0,0 +1,261 @@
+package bgp
+
+import (
+	"container-network/cluster"
+	"container-network/containerd"
+	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func init() {
+	driver.Register("bgp", func() driver.Driver { return New() })
+}
+
+func New() *BGP {
+	return &BGP{
+		announced: map[string]struct{}{},
+		learned:   map[string]string{},
+	}
+}
+
+// BGP runs an embedded BGP speaker. It announces the local container CIDR to
+// the peers in cluster.Current.BGP and desires the routes learned from them,
+// so the cluster peers are not used for route distribution.
+type BGP struct {
+	server *server.BgpServer
+	// announced holds the container /32s announced in addition to the CIDR.
+	announced map[string]struct{}
+	// learned holds the best paths learned from the peers, prefix -> next hop.
+	learned map[string]string
+	sync.Mutex
+}
+
+func (b *BGP) Init() error {
+	current := cluster.Instance.Current
+	if current.BGP == nil || current.BGP.ASN == 0 {
+		return fmt.Errorf("bgp is not configured. node: %v", current.IP)
+	}
+	routerID := current.BGP.RouterID
+	if len(routerID) == 0 {
+		routerID = current.IP
+	}
+	listenPort := current.BGP.ListenPort
+	if listenPort == 0 {
+		listenPort = 179
+	}
+
+	b.server = server.NewBgpServer()
+	go b.server.Serve()
+
+	ctx := context.Background()
+	err := b.server.StartBgp(ctx, &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:             current.BGP.ASN,
+			RouterId:        routerID,
+			ListenPort:      listenPort,
+			ListenAddresses: []string{current.IP},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start bgp. error: %v", err)
+	}
+
+	err = b.server.WatchEvent(ctx, &api.WatchEventRequest{
+		Table: &api.WatchEventRequest_Table{
+			Filters: []*api.WatchEventRequest_Table_Filter{
+				{Type: api.WatchEventRequest_Table_Filter_BEST, Init: true},
+			},
+		},
+	}, func(r *api.WatchEventResponse) {
+		for _, p := range r.GetTable().GetPaths() {
+			b.install(p)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch bgp events. error: %v", err)
+	}
+
+	if err := b.announce(current.Container.CIDR); err != nil {
+		return err
+	}
+
+	for _, peer := range current.BGP.Peers {
+		err := b.server.AddPeer(ctx, &api.AddPeerRequest{
+			Peer: &api.Peer{
+				Conf: &api.PeerConf{NeighborAddress: peer.Address, PeerAsn: peer.ASN},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add bgp peer. peer: %+v. error: %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// AddNode and RemoveNode are no-ops, the BGP peers come from the config.
+func (b *BGP) AddNode(node *cluster.Node) error {
+	return nil
+}
+
+func (b *BGP) RemoveNode(node *cluster.Node) error {
+	return nil
+}
+
+func (b *BGP) Reconcile(ctx context.Context) error {
+	if !cluster.Instance.Current.BGP.Containers {
+		return nil
+	}
+	desired := map[string]struct{}{}
+	for _, container := range containerd.Instance.List() {
+		if len(container.IP) == 0 {
+			continue
+		}
+		desired[container.IP+"/32"] = struct{}{}
+	}
+	for prefix := range desired {
+		if _, ok := b.announced[prefix]; ok {
+			continue
+		}
+		if err := b.announce(prefix); err != nil {
+			fn.Errorf("%v", err)
+			continue
+		}
+		b.announced[prefix] = struct{}{}
+	}
+	for prefix := range b.announced {
+		if _, ok := desired[prefix]; ok {
+			continue
+		}
+		if err := b.withdraw(prefix); err != nil {
+			fn.Errorf("%v", err)
+			continue
+		}
+		delete(b.announced, prefix)
+	}
+	return nil
+}
+
+// Desired returns a route for every learned prefix. The reconciler installs
+// them, records them as owned and withdraws them with the path.
+func (b *BGP) Desired() []reconcile.Object {
+	b.Lock()
+	defer b.Unlock()
+	objs := []reconcile.Object{}
+	for prefix, nextHop := range b.learned {
+		objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: prefix, Via: nextHop}})
+	}
+	return objs
+}
+
+// Scope is empty, learned routes have no device of their own.
+func (b *BGP) Scope() reconcile.Scope {
+	return reconcile.Scope{}
+}
+
+// Cleanup stops the speaker. Mgr has already removed the learned routes.
+func (b *BGP) Cleanup() error {
+	if err := b.server.StopBgp(context.Background(), &api.StopBgpRequest{}); err != nil {
+		return fmt.Errorf("failed to stop bgp. error: %v", err)
+	}
+	return nil
+}
+
+func (b *BGP) announce(prefix string) error {
+	p, err := newPath(prefix, cluster.Instance.Current.IP)
+	if err != nil {
+		return err
+	}
+	if _, err := b.server.AddPath(context.Background(), &api.AddPathRequest{Path: p}); err != nil {
+		return fmt.Errorf("failed to announce prefix. prefix: %v. error: %v", prefix, err)
+	}
+	return nil
+}
+
+func (b *BGP) withdraw(prefix string) error {
+	p, err := newPath(prefix, cluster.Instance.Current.IP)
+	if err != nil {
+		return err
+	}
+	if err := b.server.DeletePath(context.Background(), &api.DeletePathRequest{Family: p.Family, Path: p}); err != nil {
+		return fmt.Errorf("failed to withdraw prefix. prefix: %v. error: %v", prefix, err)
+	}
+	return nil
+}
+
+// install records a best path learned from a peer, or forgets a withdrawn
+// one. The next pass of the reconciler brings the kernel in line.
+func (b *BGP) install(p *api.Path) {
+	prefix, nextHop, err := parsePath(p)
+	if err != nil {
+		fn.Errorf("failed to parse bgp path. path: %v. error: %v", p, err)
+		return
+	}
+	if nextHop == cluster.Instance.Current.IP || nextHop == "0.0.0.0" {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if p.IsWithdraw {
+		if b.learned[prefix] == nextHop {
+			delete(b.learned, prefix)
+		}
+		return
+	}
+	b.learned[prefix] = nextHop
+}
+
+func newPath(prefix string, nextHop string) (*api.Path, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	nlri, err := anypb.New(&api.IPAddressPrefix{Prefix: ipNet.IP.String(), PrefixLen: uint32(ones)})
+	if err != nil {
+		return nil, err
+	}
+	origin, err := anypb.New(&api.OriginAttribute{Origin: 0})
+	if err != nil {
+		return nil, err
+	}
+	nh, err := anypb.New(&api.NextHopAttribute{NextHop: nextHop})
+	if err != nil {
+		return nil, err
+	}
+	return &api.Path{
+		Family: &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		Nlri:   nlri,
+		Pattrs: []*anypb.Any{origin, nh},
+	}, nil
+}
+
+func parsePath(p *api.Path) (prefix string, nextHop string, err error) {
+	nlri := &api.IPAddressPrefix{}
+	if err := p.Nlri.UnmarshalTo(nlri); err != nil {
+		return "", "", err
+	}
+	for _, attr := range p.Pattrs {
+		nh := &api.NextHopAttribute{}
+		if attr.MessageIs(nh) {
+			if err := attr.UnmarshalTo(nh); err != nil {
+				return "", "", err
+			}
+			nextHop = nh.NextHop
+		}
+	}
+	if len(nextHop) == 0 {
+		return "", "", fmt.Errorf("no next hop found")
+	}
+	return fmt.Sprintf("%v/%v", nlri.Prefix, nlri.PrefixLen), nextHop, nil
+}
@@ -4,177 +4,415 @@ import (
 	"container-network/cluster"
 	"container-network/containerd"
 	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/firewall"
 	"container-network/network/ipam"
-	"context"
+	"container-network/network/reconcile"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"strings"
-	"time"
+	"net"
+	"sync"
 )
 
-func New() *Bridge {
-	b := &Bridge{Br0: "br0"}
+func New(reconciler *reconcile.Reconciler) *Bridge {
+	b := &Bridge{Br0: "br0", attachment: "bridge", reconciler: reconciler}
+	if container := cluster.Instance.Current.Container; len(container.Attachment) > 0 {
+		b.attachment = container.Attachment
+		b.mode = container.AttachmentMode
+	}
+	switch b.attachment {
+	case "bridge":
+	case "macvlan":
+		b.Br0 = "macvlan0"
+		if len(b.mode) == 0 {
+			b.mode = "bridge"
+		}
+	case "ipvlan":
+		b.Br0 = "ipvlan0"
+		if len(b.mode) == 0 {
+			b.mode = "l2"
+		}
+	default:
+		panic(fmt.Errorf("unknown attachment: %q. available: bridge, macvlan, ipvlan", b.attachment))
+	}
+	if b.attachment != "bridge" && len(cluster.Instance.Current.Networks) > 0 {
+		panic(fmt.Errorf("named networks require the bridge attachment. attachment: %v", b.attachment))
+	}
+	fw, err := firewall.New()
+	if err != nil {
+		panic(err)
+	}
+	b.firewall = fw
 	if err := b.init(); err != nil {
 		panic(err)
 	}
 	return b
 }
 
+// Bridge plugs containers into the host. With the bridge attachment each
+// container gets a veth pair enslaved to br0. With macvlan or ipvlan each
+// container gets a sub-interface of the node interface instead, and Br0 is a
+// host-side sub-interface of the same kind that holds the gateway.
+// Containers of a named network are enslaved to that network's bridge.
 type Bridge struct {
-	Br0 string
+	Br0        string
+	attachment string
+	mode       string
+	firewall   firewall.Firewall
+	reconciler *reconcile.Reconciler
+	// Mutex serializes the per-container work of Mgr and the CNI plugin.
+	sync.Mutex
 }
 
-func (b *Bridge) setVethPairs(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Second * 5):
-			for _, container := range containerd.Instance.List() {
-				if len(container.Veth0) != 0 && len(container.Veth1) != 0 {
-					continue
-				}
-				veth0 := fmt.Sprintf("veth0%v", container.Name)
-				veth1 := fmt.Sprintf("veth1%v", container.Name)
-
-				cmd := exec.Command("ip", "link", "add", veth0, "type", "veth", "peer", "name", veth1)
-				cmdout, err := cmd.CombinedOutput()
-				if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-					fn.Errorf("failed to create veth pair. cmdout: %s, error: %v", cmdout, err)
-					continue
-				}
+// device returns the host device that holds the gateway of the network.
+func (b *Bridge) device(network *cluster.Network) string {
+	if network.Name == cluster.DefaultNetwork {
+		return b.Br0
+	}
+	return network.Bridge
+}
 
-				cmd = exec.Command("ip", "link", "set", veth0, "netns", container.Name)
-				cmdout, err = cmd.CombinedOutput()
-				if err != nil {
-					fn.Errorf("failed to set veth0 to netns. cmdout: %s, error: %v", cmdout, err)
-					continue
-				}
-				newContainer := container
-				newContainer.Veth0 = veth0
-				newContainer.Veth1 = veth1
-				containerd.Instance.Set(newContainer)
+// linked reports whether the container's links have been created.
+func (b *Bridge) linked(container *containerd.Container) bool {
+	if len(container.Veth0) == 0 {
+		return false
+	}
+	return b.attachment != "bridge" || len(container.Veth1) != 0
+}
+
+// addSubInterface creates a macvlan or ipvlan sub-interface of the node interface.
+func (b *Bridge) addSubInterface(name string) error {
+	return nl.AddSubInterface(name, cluster.Instance.Current.Interface, b.attachment, b.mode)
+}
+
+// link creates the container's links and moves the container side into its
+// netns, renamed to ifName if set. It publishes a copy of the container with
+// its links and returns it.
+func (b *Bridge) link(container *containerd.Container, ifName string) (*containerd.Container, error) {
+	veth0 := fn.LinkName("veth0", container.Name)
+	veth1 := fn.LinkName("veth1", container.Name)
+
+	if b.attachment == "bridge" {
+		if err := nl.AddVeth(veth0, veth1); err == nil {
+			// The tag makes the host side veth owned, see reconcile.Tagged.
+			if err := reconcile.TagLink(veth1); err != nil {
+				return nil, fmt.Errorf("failed to tag veth1. error: %v", err)
 			}
+		} else if !nl.IsExist(err) {
+			return nil, fmt.Errorf("failed to create veth pair. error: %v", err)
+		}
+	} else {
+		veth1 = ""
+		if err := b.addSubInterface(veth0); err != nil && !nl.IsExist(err) {
+			return nil, fmt.Errorf("failed to create %v. error: %v", b.attachment, err)
 		}
 	}
+
+	if err := nl.SetLinkNetns(veth0, container.Name); err != nil {
+		return nil, fmt.Errorf("failed to set veth0 to netns. error: %v", err)
+	}
+	newContainer := *container
+	newContainer.Veth0 = veth0
+	newContainer.Veth1 = veth1
+	newContainer.Network = cluster.Instance.Current.NetworkOf(container.Name).Name
+	if len(ifName) > 0 {
+		if err := b.rename(&newContainer, ifName); err != nil {
+			return nil, err
+		}
+	}
+	containerd.Instance.Set(&newContainer)
+	return &newContainer, nil
 }
 
-func (b *Bridge) init() error {
-	cmd := exec.Command("brctl", "addbr", b.Br0)
-	cmdout, err := cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "already exists") {
-		return fmt.Errorf("failed to create bridge. cmdout: %s. error: %v", cmdout, err)
+// rename renames the container side link inside the netns and records the
+// name in container, which must not be the one of the registry.
+func (b *Bridge) rename(container *containerd.Container, ifName string) error {
+	if container.Veth0 == ifName {
+		return nil
 	}
+	ns := nl.InNetns(container.Name)
+	for _, step := range []func() error{
+		func() error { return ns.SetLinkDown(container.Veth0) },
+		func() error { return ns.SetLinkName(container.Veth0, ifName) },
+		func() error { return ns.SetLinkUp(ifName) },
+	} {
+		if err := step(); err != nil {
+			return fmt.Errorf("failed to rename veth0. container: %+v. ifName: %v. error: %v", container, ifName, err)
+		}
+	}
+	container.Veth0 = ifName
+	return nil
+}
 
-	cmd = exec.Command("ip", "addr", "add", fmt.Sprintf("%v/24", cluster.Instance.Current.Container.Gateway), "dev", b.Br0)
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-		return fmt.Errorf("failed to add ip to bridge. cmdout: %s. error: %v", cmdout, err)
+func (b *Bridge) init() error {
+	if err := b.reconciler.Ensure(b.hostObjects()); err != nil {
+		return err
 	}
+	b.initContainers()
+	return nil
+}
 
-	cmd = exec.Command("ip", "link", "set", b.Br0, "up")
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to bring up bridge. cmdout: %s. error: %v", cmdout, err)
+// hostObjects returns the host side of every network: its device with the
+// gateway addresses, forwarding and the firewall rules.
+func (b *Bridge) hostObjects() []reconcile.Object {
+	add := func() error { return nl.AddBridge(b.Br0) }
+	if b.attachment != "bridge" {
+		add = func() error { return b.addSubInterface(b.Br0) }
 	}
+	objs := []reconcile.Object{&reconcile.Link{Name: b.Br0, Add: add}}
 
-	cmd = exec.Command("sysctl", "net.ipv4.conf.all.forwarding=1")
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to set net.ipv4.conf.all.forwarding=1: %s. cmdout: %s", err, cmdout)
+	forwarding := map[string]struct{}{}
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		device := b.device(network)
+		if network.Name != cluster.DefaultNetwork {
+			objs = append(objs, &reconcile.Link{Name: device, Add: func() error { return nl.AddBridge(device) }})
+		}
+		current := network.Container
+		if len(current.Gateway) > 0 {
+			prefix, err := prefixLen(current.CIDR)
+			if err != nil {
+				fn.Errorf("failed to parse CIDR. network: %v. error: %v", network.Name, err)
+			} else {
+				objs = append(objs, &reconcile.Addr{Dev: device, Addr: fmt.Sprintf("%v/%v", current.Gateway, prefix)})
+			}
+		}
+		if len(current.Gateway6) > 0 {
+			prefix, err := prefixLen(current.CIDR6)
+			if err != nil {
+				fn.Errorf("failed to parse CIDR6. network: %v. error: %v", network.Name, err)
+			} else {
+				objs = append(objs, &reconcile.Addr{Dev: device, Addr: fmt.Sprintf("%v/%v", current.Gateway6, prefix), NoDAD: true})
+			}
+		}
+		if len(current.CIDR) > 0 {
+			forwarding["net.ipv4.conf.all.forwarding"] = struct{}{}
+		}
+		if len(current.CIDR6) > 0 {
+			forwarding["net.ipv6.conf.all.forwarding"] = struct{}{}
+		}
+	}
+	for _, key := range []string{"net.ipv4.conf.all.forwarding", "net.ipv6.conf.all.forwarding"} {
+		if _, ok := forwarding[key]; ok {
+			objs = append(objs, &reconcile.Sysctl{Name: key, Value: "1"})
+		}
 	}
 
-	matched, err := b.matchedPOSTROUTING(cluster.Instance.Current)
-	if err != nil {
-		return fmt.Errorf("failed to match POSTROUTING: %v", err)
+	return append(objs, &reconcile.Firewall{Firewall: b.firewall, Rules: b.rules()})
+}
+
+// containerObjects returns the links, addresses and default routes of a
+// linked container. Until the container is configured, that is only its
+// host side veth, which keeps the collector away from it.
+func (b *Bridge) containerObjects(container *containerd.Container) []reconcile.Object {
+	if !b.linked(container) {
+		return nil
 	}
-	if !matched {
-		cmd = exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", cluster.Instance.Current.Container.CIDR, "!", "-o", b.Br0, "-j", "MASQUERADE")
-		cmdout, err = cmd.CombinedOutput()
+	network := cluster.Instance.Current.Network(container.Network)
+	objs := []reconcile.Object{}
+	if b.attachment == "bridge" && network != nil {
+		objs = append(objs, &reconcile.Link{Name: container.Veth1, Master: b.device(network)})
+	}
+	if network == nil || !b.configured(container, network) {
+		return objs
+	}
+	current := network.Container
+	if len(container.IP) > 0 {
+		prefix, err := prefixLen(current.CIDR)
 		if err != nil {
-			return fmt.Errorf("failed to set POSTROUTING: %s. cmdout: %s", err, cmdout)
+			fn.Errorf("failed to parse CIDR. network: %v. error: %v", network.Name, err)
+		} else {
+			objs = append(objs, &reconcile.Addr{Netns: container.Name, Dev: container.Veth0, Addr: fmt.Sprintf("%v/%v", container.IP, prefix)})
 		}
 	}
+	if len(container.IP6) > 0 {
+		prefix, err := prefixLen(current.CIDR6)
+		if err != nil {
+			fn.Errorf("failed to parse CIDR6. network: %v. error: %v", network.Name, err)
+		} else {
+			objs = append(objs, &reconcile.Addr{Netns: container.Name, Dev: container.Veth0, Addr: fmt.Sprintf("%v/%v", container.IP6, prefix), NoDAD: true})
+		}
+	}
+	objs = append(objs, &reconcile.Link{Netns: container.Name, Name: container.Veth0})
 
-	b.initContainers()
+	if len(container.IP) > 0 {
+		objs = append(objs, b.defaultRoute(container, "0.0.0.0/0", current.Gateway))
+	}
+	if len(container.IP6) > 0 {
+		objs = append(objs, b.defaultRoute(container, "::/0", current.Gateway6))
+	}
+	return objs
+}
 
-	return nil
+// defaultRoute routes dst through the gateway. l3 ipvlan slaves do not answer
+// ARP/ND, so with them the default route points at the device instead.
+func (b *Bridge) defaultRoute(container *containerd.Container, dst string, gateway string) reconcile.Object {
+	if b.attachment == "ipvlan" && b.mode == "l3" {
+		gateway = ""
+	}
+	return &reconcile.Route{Netns: container.Name, Route: nl.Route{Dst: dst, Via: gateway, Dev: container.Veth0}}
 }
 
-func (b *Bridge) initContainers() {
+// Desired returns the host state of the networks and of every container.
+// It is called with the reconciler locked, so it must not take the bridge lock.
+func (b *Bridge) Desired() []reconcile.Object {
+	objs := b.hostObjects()
 	for _, container := range containerd.Instance.List() {
-		newContainer := container
-		cmd := exec.Command("ip", "netns", "exec", container.Name, "ip", "addr", "show", "veth0"+container.Name)
-		// cmd := exec.Command("ip", "netns", "exec", container.Name, "ip", "link", "show", "veth0"+container.Name)
-		if cmdout, err := cmd.CombinedOutput(); err == nil {
-			re := regexp.MustCompile(`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})`)
-			newContainer.Veth0 = fmt.Sprintf("veth0%v", container.Name)
-			newContainer.Veth1 = fmt.Sprintf("veth1%v", container.Name)
-			newContainer.IP = re.FindString(string(cmdout))
-			containerd.Instance.Set(newContainer)
+		objs = append(objs, b.containerObjects(container)...)
+	}
+	return objs
+}
+
+// rules masquerades every local network and drops forwarded traffic between
+// the CIDRs of different networks on every node, unless the destination
+// network allows the source network.
+func (b *Bridge) rules() *firewall.Rules {
+	rules := &firewall.Rules{}
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		for _, cidr := range []string{network.Container.CIDR, network.Container.CIDR6} {
+			if len(cidr) > 0 {
+				rules.Masquerades = append(rules.Masquerades, &firewall.Masquerade{CIDR: cidr, Device: b.device(network)})
+			}
+		}
+	}
+	if len(cluster.Instance.Current.Networks) == 0 {
+		return rules
+	}
+
+	cidrs := networkCIDRs()
+	for dst, dstCIDRs := range cidrs {
+		allow := map[string]struct{}{dst: {}}
+		if network := cluster.Instance.Current.Network(dst); network != nil {
+			for _, name := range network.Allow {
+				allow[name] = struct{}{}
+			}
+		}
+		for src, srcCIDRs := range cidrs {
+			if _, ok := allow[src]; ok {
+				continue
+			}
+			for _, srcCIDR := range srcCIDRs {
+				for _, dstCIDR := range dstCIDRs {
+					if isIPv6(srcCIDR) != isIPv6(dstCIDR) {
+						continue
+					}
+					rules.Drops = append(rules.Drops, &firewall.Drop{Src: srcCIDR, Dst: dstCIDR})
+				}
+			}
 		}
 	}
+	return rules
 }
 
-func (b *Bridge) Running(ctx context.Context) {
-	go b.setVethPairs(ctx)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Second * 5):
-			for _, container := range containerd.Instance.List() {
-				if len(container.IP) > 0 || len(container.Veth0) == 0 || len(container.Veth1) == 0 {
-					continue
+// networkCIDRs returns the IPv4 and IPv6 container CIDRs of every node,
+// keyed by network name.
+func networkCIDRs() map[string][]string {
+	cidrs := map[string][]string{}
+	for _, node := range append([]*cluster.Node{cluster.Instance.Current}, cluster.Instance.Peers()...) {
+		for _, network := range node.AllNetworks() {
+			if network.Container == nil {
+				continue
+			}
+			for _, cidr := range []string{network.Container.CIDR, network.Container.CIDR6} {
+				if len(cidr) > 0 {
+					cidrs[network.Name] = append(cidrs[network.Name], cidr)
 				}
-				containerIP, err := b.setup(container)
-				if err != nil {
-					fn.Errorf("failed to setup veth pair for container %s: %v", container.Name, err)
-					continue
+			}
+		}
+	}
+	return cidrs
+}
+
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+func (b *Bridge) initContainers() {
+	for _, container := range containerd.Instance.List() {
+		newContainer := *container
+		candidates := []string{fn.LinkName("veth0", container.Name)}
+		// Containers added through CNI have their link renamed, eth0 by default.
+		// It is only ours if our host side veth exists.
+		if b.attachment == "bridge" && nl.LinkExists(fn.LinkName("veth1", container.Name)) {
+			candidates = append(candidates, "eth0")
+		}
+		for _, veth0 := range candidates {
+			ips, err := nl.InNetns(container.Name).Addrs(veth0)
+			if err != nil {
+				continue
+			}
+			newContainer.Veth0 = veth0
+			if b.attachment == "bridge" {
+				newContainer.Veth1 = fn.LinkName("veth1", container.Name)
+			}
+			newContainer.Network = cluster.Instance.Current.NetworkOf(container.Name).Name
+			if lease, ok := ipam.Instance.Get(container.Name); ok {
+				newContainer.ID = lease.ID
+			}
+			for _, ip := range ips {
+				if ip.To4() != nil && len(newContainer.IP) == 0 {
+					newContainer.IP = ip.String()
+				} else if ip.To4() == nil && len(newContainer.IP6) == 0 {
+					newContainer.IP6 = ip.String()
 				}
-				newContainer := container
-				newContainer.IP = containerIP
-				containerd.Instance.Set(newContainer)
 			}
+			containerd.Instance.Set(&newContainer)
+			if err := ipam.Instance.Adopt(newContainer.Name, newContainer.Network, newContainer.IP, newContainer.IP6); err != nil {
+				fn.Errorf("%v", err)
+			}
+			break
 		}
 	}
 }
 
-func (b *Bridge) setup(container *containerd.Container) (containerIP string, err error) {
-	containerIP, err = ipam.FindAvailableIP()
-	if err != nil {
-		return containerIP, fmt.Errorf("failed to find available ip: %v", err)
+// configured reports whether the container has an address of every family configured on its network.
+func (b *Bridge) configured(container *containerd.Container, network *cluster.Network) bool {
+	current := network.Container
+	return (len(current.CIDR) == 0 || len(container.IP) > 0) && (len(current.CIDR6) == 0 || len(container.IP6) > 0)
+}
+
+// Sync links and configures the container, unless it already is. Mgr calls
+// it when containerd reports the container, and again while it fails.
+func (b *Bridge) Sync(name string) error {
+	b.Lock()
+	defer b.Unlock()
+	container, ok := containerd.Instance.Get(name)
+	if !ok {
+		return nil
 	}
-	cmd := exec.Command("brctl", "addif", b.Br0, container.Veth1)
-	cmdout, err := cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "already") {
-		return containerIP, fmt.Errorf("failed to add veth to bridge. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
+	var err error
+	if !b.linked(container) {
+		if container, err = b.link(container, ""); err != nil {
+			return err
+		}
 	}
-
-	cmd = exec.Command("ip", "netns", "exec", container.Name, "ip", "addr", "add", fmt.Sprintf("%v/24", containerIP), "dev", container.Veth0)
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-		return containerIP, fmt.Errorf("failed to add ip to veth. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
+	if _, err := b.configure(container); err != nil {
+		return fmt.Errorf("failed to setup veth pair for container %s: %v", container.Name, err)
 	}
+	return nil
+}
 
-	cmd = exec.Command("ip", "netns", "exec", container.Name, "ip", "link", "set", container.Veth0, "up")
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil {
-		return containerIP, fmt.Errorf("failed to bring up veth. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
+// configure assigns addresses to a linked container, unless it already has
+// them, and puts its links, addresses and routes in place. It returns the
+// container with its addresses, a copy published in the registry if they
+// were assigned.
+func (b *Bridge) configure(container *containerd.Container) (*containerd.Container, error) {
+	network := cluster.Instance.Current.Network(container.Network)
+	if network == nil {
+		return nil, fmt.Errorf("unknown network %v", container.Network)
 	}
-
-	cmd = exec.Command("ip", "link", "set", container.Veth1, "up")
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil {
-		return containerIP, fmt.Errorf("failed to bring up veth. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
+	if !b.configured(container, network) {
+		lease, err := ipam.Instance.Allocate(container.Name, network)
+		if err != nil {
+			return nil, err
+		}
+		newContainer := *container
+		newContainer.IP = lease.IP
+		newContainer.IP6 = lease.IP6
+		containerd.Instance.Set(&newContainer)
+		container = &newContainer
 	}
-
-	cmd = exec.Command("ip", "netns", "exec", container.Name, "route", "add", "default", "gw", cluster.Instance.Current.Container.Gateway, container.Veth0)
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-		return containerIP, fmt.Errorf("failed to add default route. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
+	if err := b.reconciler.Ensure(b.containerObjects(container)); err != nil {
+		return nil, fmt.Errorf("failed to configure container. container: %+v. error: %v", container, err)
 	}
 
 	// matched, err := b.matchedPREROUTING(container)
@@ -189,7 +427,60 @@ func (b *Bridge) setup(container *containerd.Container) (containerIP string, err
 	// 	}
 	// }
 
-	return containerIP, nil
+	return container, nil
+}
+
+// Add wires up the container in netns name synchronously, with the container
+// side link named ifName. It is used by the CNI plugin.
+func (b *Bridge) Add(id string, name string, ifName string) (*containerd.Container, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	newContainer := containerd.Container{Name: name}
+	if container, ok := containerd.Instance.Get(name); ok {
+		newContainer = *container
+	}
+	newContainer.ID = id
+	container := &newContainer
+
+	var err error
+	if !b.linked(container) {
+		if container, err = b.link(container, ifName); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := b.rename(container, ifName); err != nil {
+			return nil, err
+		}
+		containerd.Instance.Set(container)
+	}
+	if container, err = b.configure(container); err != nil {
+		return nil, fmt.Errorf("failed to setup veth pair for container %s: %v", name, err)
+	}
+	if err := ipam.Instance.SetID(container.Name, id); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// Del drops the container from the registry, releases its addresses and
+// removes its host side link and its addresses and routes.
+func (b *Bridge) Del(name string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	container, ok := containerd.Instance.Get(name)
+	if !ok {
+		return nil
+	}
+	// The container leaves the registry first, so a concurrent pass of the
+	// reconciler does not put its objects back.
+	objs := b.containerObjects(container)
+	containerd.Instance.Delete(name)
+	if err := b.reconciler.Remove(objs); err != nil {
+		return err
+	}
+	return ipam.Instance.Release(name)
 }
 
 // func (b *Bridge) matchedPREROUTING(container *containerd.Container) (bool, error) {
@@ -209,49 +500,25 @@ func (b *Bridge) setup(container *containerd.Container) (containerIP string, err
 // 	return matched, nil
 // }
 
-func (b *Bridge) matchedPOSTROUTING(node *cluster.Node) (bool, error) {
-	cmd := exec.Command("iptables", "-t", "nat", "-S", "POSTROUTING")
-	cmdout, err := cmd.CombinedOutput()
-	if err != nil {
-		return false, fmt.Errorf("failed to get iptables rules. node: %+v. cmdout: %s. error: %v", node, cmdout, err)
-	}
-	rule := fmt.Sprintf("-s %v ! -o %v -j MASQUERADE", node.Container.CIDR, b.Br0)
-	rules := strings.Split(string(cmdout), "\n")
-	matched := false
-	for _, r := range rules {
-		if strings.Contains(r, rule) {
-			matched = true
-		}
-	}
-	return matched, nil
+// Scope has the collector look for host side veths of containers that are gone.
+func (b *Bridge) Scope() reconcile.Scope {
+	return reconcile.Scope{LinkPrefixes: []string{"veth1"}}
 }
 
-// func (b *Bridge) Cleanup() error {
-// 	cmd := exec.Command("ip", "link", "set", b.Br0, "down")
-// 	cmdout, err := cmd.CombinedOutput()
-// 	if cmdout, err := fn.CheckCMDOut(cmdout, err); err != nil {
-// 		return fmt.Errorf("failed to set down br0. cmdout: %s. error: %v", cmdout, err)
-// 	}
-
-// 	cmd = exec.Command("brctl", "delbr", b.Br0)
-// 	cmdout, err = cmd.CombinedOutput()
-// 	if cmdout, err := fn.CheckCMDOut(cmdout, err); err != nil {
-// 		return fmt.Errorf("failed to delete br0. cmdout: %s. error: %v", cmdout, err)
-// 	}
-
-// 	node, err := store.Instance.ReadNode(b.NodeName)
-// 	if err != nil {
-// 		return fmt.Errorf("failed to read node. node: %v. error: %v", b.NodeName, err)
-// 	}
-
-// 	for _, container := range node.Containers {
-// 		cmd = exec.Command("ip", "link", "del", container.Veth1)
-// 		cmdout, err = cmd.CombinedOutput()
-// 		if cmdout, err := fn.CheckCMDOut(cmdout, err); err != nil {
-// 			fn.Errorf("failed to delete veth1. container: %+v. cmdout: %s. error: %v", container, cmdout, err)
-// 			continue
-// 		}
-// 	}
+// Cleanup removes what Desired describes, the containers' links, addresses
+// and routes first and then the networks' devices and firewall rules.
+// Sysctls are left as they are.
+func (b *Bridge) Cleanup() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.reconciler.Remove(b.Desired())
+}
 
-// 	return nil
-// }
+func prefixLen(cidr string) (int, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones, nil
+}
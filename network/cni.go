@@ -0,0 +1,239 @@
+package network
+
+import (
+	"container-network/cluster"
+	"container-network/containerd"
+	"container-network/fn"
+	"container-network/network/bridge"
+	"container-network/network/cni"
+	"container-network/network/ipam"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/sys/unix"
+)
+
+// handleCNI registers the CNI endpoints on the local socket. They bind mount
+// netns files and create links as root, so they are not served to the cluster.
+func (m *Mgr) handleCNI() {
+	cluster.Instance.HandleLocal("POST", "/cni/add", m.cniAdd)
+	cluster.Instance.HandleLocal("POST", "/cni/check", m.cniCheck)
+	cluster.Instance.HandleLocal("POST", "/cni/del", m.cniDel)
+}
+
+func (m *Mgr) getBridge() *bridge.Bridge {
+	m.Lock()
+	defer m.Unlock()
+	return m.bridge
+}
+
+func (m *Mgr) cniAdd(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	req, b, ok := m.cniRequest(w, r)
+	if !ok {
+		return
+	}
+	name, err := netnsName(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	container, err := b.Add(req.ContainerID, name, req.IfName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeCNIResponse(w, container)
+}
+
+func (m *Mgr) cniCheck(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	req, _, ok := m.cniRequest(w, r)
+	if !ok {
+		return
+	}
+	container := findContainer(req.ContainerID)
+	if container == nil {
+		http.Error(w, fmt.Sprintf("container not found: %v", req.ContainerID), http.StatusNotFound)
+		return
+	}
+	if len(container.IP) == 0 && len(container.IP6) == 0 {
+		http.Error(w, fmt.Sprintf("container has no address: %v", req.ContainerID), http.StatusInternalServerError)
+		return
+	}
+	if container.Veth0 != req.IfName {
+		http.Error(w, fmt.Sprintf("container interface mismatch. expected: %v. actual: %v", req.IfName, container.Veth0), http.StatusInternalServerError)
+		return
+	}
+	writeCNIResponse(w, container)
+}
+
+func (m *Mgr) cniDel(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	req, b, ok := m.cniRequest(w, r)
+	if !ok {
+		return
+	}
+	if container := findContainer(req.ContainerID); container != nil {
+		if err := b.Del(container.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := unmountNetns(req.ContainerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *Mgr) cniRequest(w http.ResponseWriter, r *http.Request) (*cni.Request, *bridge.Bridge, bool) {
+	b := m.getBridge()
+	if b == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+	req := &cni.Request{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return req, b, true
+}
+
+func writeCNIResponse(w http.ResponseWriter, container *containerd.Container) {
+	network := cluster.Instance.Current.Network(container.Network)
+	if network == nil {
+		http.Error(w, fmt.Sprintf("unknown network %v", container.Network), http.StatusInternalServerError)
+		return
+	}
+	resp := &cni.Response{HostInterface: container.Veth1, Interface: container.Veth0}
+	if len(container.IP) > 0 {
+		_, ipNet, err := net.ParseCIDR(network.Container.CIDR)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ones, _ := ipNet.Mask.Size()
+		resp.IPs = append(resp.IPs, &cni.IP{Address: fmt.Sprintf("%v/%v", container.IP, ones), Gateway: network.Container.Gateway})
+	}
+	if len(container.IP6) > 0 {
+		_, ipNet, err := net.ParseCIDR(network.Container.CIDR6)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ones, _ := ipNet.Mask.Size()
+		resp.IPs = append(resp.IPs, &cni.IP{Address: fmt.Sprintf("%v/%v", container.IP6, ones), Gateway: network.Container.Gateway6})
+	}
+	bys, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// findContainer returns the container with the runtime ID. After a restart
+// the registry no longer knows the ID, the lease of the container does.
+func findContainer(id string) *containerd.Container {
+	for _, container := range containerd.Instance.List() {
+		if container.ID == id {
+			return container
+		}
+	}
+	if lease, ok := ipam.Instance.ByID(id); ok {
+		if container, ok := containerd.Instance.Get(lease.Container); ok {
+			return container
+		}
+	}
+	return nil
+}
+
+// cniNetnsName is the name a netns living outside /var/run/netns is bind
+// mounted under. It is short enough to derive link names from.
+func cniNetnsName(id string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "cni-" + id
+}
+
+// netnsName returns the name of the container netns under fn.NetnsDir,
+// bind mounting it there first if the runtime created it elsewhere. The path
+// must be a network namespace, nothing else is ever mounted.
+func netnsName(req *cni.Request) (string, error) {
+	if err := checkNetns(req.Netns); err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(req.Netns)
+	if dir == fn.NetnsDir || dir == "/run/netns" {
+		return filepath.Base(req.Netns), nil
+	}
+	name := cniNetnsName(req.ContainerID)
+	target := filepath.Join(fn.NetnsDir, name)
+	if _, err := os.Stat(target); err == nil {
+		return name, nil
+	}
+	if err := fn.Exec.Apply(fmt.Sprintf("mkdir -p %v", fn.NetnsDir), func() error { return os.MkdirAll(fn.NetnsDir, 0755) }); err != nil {
+		return "", err
+	}
+	if err := fn.Exec.Apply(fmt.Sprintf("touch %v", target), func() error { return os.WriteFile(target, nil, 0444) }); err != nil {
+		return "", err
+	}
+	err := fn.Exec.Apply(fn.CommandLine("mount", "--bind", req.Netns, target), func() error {
+		return unix.Mount(req.Netns, target, "", unix.MS_BIND, "")
+	})
+	if err != nil {
+		fn.Exec.Apply(fmt.Sprintf("rm %v", target), func() error { return os.Remove(target) })
+		return "", fmt.Errorf("failed to bind mount netns. netns: %v. error: %v", req.Netns, err)
+	}
+	return name, nil
+}
+
+// checkNetns fails unless path is a network namespace: an nsfs inode of the
+// network type, e.g. /proc/<pid>/ns/net or a bind mount of one.
+func checkNetns(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open netns. netns: %v. error: %v", path, err)
+	}
+	defer f.Close()
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(f.Fd()), &st); err != nil {
+		return fmt.Errorf("failed to stat netns. netns: %v. error: %v", path, err)
+	}
+	if st.Type != unix.NSFS_MAGIC {
+		return fmt.Errorf("not a namespace: %v", path)
+	}
+	nstype, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+	if err != nil {
+		return fmt.Errorf("failed to get namespace type. netns: %v. error: %v", path, err)
+	}
+	if nstype != unix.CLONE_NEWNET {
+		return fmt.Errorf("not a network namespace: %v", path)
+	}
+	return nil
+}
+
+func unmountNetns(id string) error {
+	target := filepath.Join(fn.NetnsDir, cniNetnsName(id))
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		return nil
+	}
+	err := fn.Exec.Apply(fmt.Sprintf("umount %v", target), func() error {
+		// EINVAL: target is not a mount point.
+		if err := unix.Unmount(target, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unmount netns. netns: %v. error: %v", target, err)
+	}
+	return fn.Exec.Apply(fmt.Sprintf("rm %v", target), func() error { return os.Remove(target) })
+}
@@ -0,0 +1,21 @@
+package cni
+
+// Request is sent by the CNI plugin to the daemon for ADD, CHECK and DEL.
+type Request struct {
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName"`
+}
+
+// Response describes the container as wired up by the daemon.
+type Response struct {
+	HostInterface string `json:"hostInterface,omitempty"`
+	Interface     string `json:"interface"`
+	IPs           []*IP  `json:"ips"`
+}
+
+type IP struct {
+	// Address is in CIDR notation, e.g. 172.18.10.2/24.
+	Address string `json:"address"`
+	Gateway string `json:"gateway,omitempty"`
+}
@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"container-network/cluster"
+	"container-network/network/reconcile"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Driver is a cross-node network backend. Mgr calls Init once, AddNode and
+// RemoveNode as cluster.Instance.Peers changes, and Reconcile periodically.
+type Driver interface {
+	Init() error
+	Reconcile(ctx context.Context) error
+	AddNode(node *cluster.Node) error
+	RemoveNode(node *cluster.Node) error
+	Cleanup() error
+}
+
+// Stateful is implemented by drivers that describe the host state they want
+// instead of applying it. Mgr hands the objects Desired returns to the
+// reconciler after every Reconcile, and Scope to the collector.
+type Stateful interface {
+	Desired() []reconcile.Object
+	Scope() reconcile.Scope
+}
+
+type Factory func() Driver
+
+var (
+	locker    sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a driver available by name. It is meant to be called from
+// the init function of the driver package.
+func Register(name string, factory Factory) {
+	locker.Lock()
+	defer locker.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("network driver already registered: %v", name))
+	}
+	factories[name] = factory
+}
+
+func New(name string) (Driver, error) {
+	locker.Lock()
+	factory, ok := factories[name]
+	locker.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown network driver: %q. available: %v", name, strings.Join(Drivers(), ", "))
+	}
+	return factory(), nil
+}
+
+func Drivers() []string {
+	locker.Lock()
+	defer locker.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
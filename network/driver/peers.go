@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"container-network/cluster"
+	"sort"
+)
+
+// Peers tracks the peers Mgr hands to a driver, keyed by node IP. Drivers
+// that describe their peers in Desired embed it for AddNode and RemoveNode,
+// and the reconciler installs and withdraws what they describe.
+type Peers struct {
+	nodes map[string]*cluster.Node
+}
+
+func (p *Peers) AddNode(node *cluster.Node) error {
+	if p.nodes == nil {
+		p.nodes = map[string]*cluster.Node{}
+	}
+	p.nodes[node.IP] = node
+	return nil
+}
+
+func (p *Peers) RemoveNode(node *cluster.Node) error {
+	delete(p.nodes, node.IP)
+	return nil
+}
+
+// Nodes returns the peers sorted by IP.
+func (p *Peers) Nodes() []*cluster.Node {
+	nodes := make([]*cluster.Node, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].IP < nodes[j].IP })
+	return nodes
+}
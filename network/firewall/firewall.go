@@ -0,0 +1,74 @@
+package firewall
+
+import (
+	"container-network/fn"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// Firewall installs the NAT and filter rules of the container networks.
+type Firewall interface {
+	// Apply makes the installed rules match rules.
+	Apply(rules *Rules) error
+	// Installed reports whether the installed rules match rules.
+	Installed(rules *Rules) (bool, error)
+	// Remove deletes the rules installed by Apply.
+	Remove(rules *Rules) error
+}
+
+// Rules are all the firewall rules of the node.
+type Rules struct {
+	// Masquerades source NAT traffic leaving a container CIDR through any
+	// device other than its own.
+	Masquerades []*Masquerade
+	// Drops block forwarded traffic between container CIDRs. Replies of
+	// allowed connections are always let through.
+	Drops []*Drop
+}
+
+type Masquerade struct {
+	CIDR   string
+	Device string
+}
+
+type Drop struct {
+	Src string
+	Dst string
+}
+
+// New returns the firewall backend named by --firewall, iptables or nftables,
+// or the one the host uses if it is not set.
+func New() (Firewall, error) {
+	backend := fn.Args("firewall")
+	if len(backend) == 0 {
+		backend = detect()
+	}
+	switch backend {
+	case "iptables":
+		return NewIPTables(), nil
+	case "nftables":
+		return NewNFTables(), nil
+	}
+	return nil, fmt.Errorf("unknown firewall: %q. available: iptables, nftables", backend)
+}
+
+// detect picks nftables when iptables is the nft shim or missing while nft
+// is installed, and iptables otherwise.
+func detect() string {
+	cmdout, err := fn.Exec.Query("iptables", "--version")
+	if err == nil && fn.MatchCMDOut(cmdout, "nf_tables") {
+		return "nftables"
+	}
+	if err != nil {
+		if _, err := exec.LookPath("nft"); err == nil {
+			return "nftables"
+		}
+	}
+	return "iptables"
+}
+
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
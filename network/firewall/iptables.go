@@ -0,0 +1,202 @@
+package firewall
+
+import (
+	"container-network/fn"
+	"fmt"
+	"strings"
+)
+
+func NewIPTables() *IPTables {
+	return &IPTables{chain: "CN-ISOLATION", comment: "container-network"}
+}
+
+// IPTables appends masquerade rules to the nat POSTROUTING chain and keeps
+// the drops in its own chain, jumped to from FORWARD. The rules outside the
+// chain carry comment, so Remove only deletes the daemon's own rules.
+type IPTables struct {
+	chain   string
+	comment string
+}
+
+func (t *IPTables) Apply(rules *Rules) error {
+	for _, m := range rules.Masquerades {
+		if err := t.masquerade(m); err != nil {
+			return err
+		}
+	}
+	if len(rules.Drops) == 0 {
+		return nil
+	}
+	return t.isolate(rules.Drops)
+}
+
+// Installed checks every rule with -C. The isolation chain must also hold
+// no rule besides them.
+func (t *IPTables) Installed(rules *Rules) (bool, error) {
+	for _, m := range rules.Masquerades {
+		iptables, rule := t.masqueradeRule(m)
+		if _, err := fn.Exec.Query(iptables, append([]string{"-t", "nat", "-C"}, rule...)...); err != nil {
+			return false, nil
+		}
+	}
+	if len(rules.Drops) == 0 {
+		return true, nil
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		isolation := t.isolationRules(rules.Drops, iptables == "ip6tables")
+		if isolation == nil {
+			continue
+		}
+		for _, rule := range isolation {
+			if _, err := fn.Exec.Query(iptables, append([]string{"-C", t.chain}, rule...)...); err != nil {
+				return false, nil
+			}
+		}
+		cmdout, err := fn.Exec.Query(iptables, "-S", t.chain)
+		if err != nil {
+			return false, nil
+		}
+		// -S prints the -N line of the chain before its rules.
+		if len(strings.Split(strings.TrimSpace(string(cmdout)), "\n")) != len(isolation)+1 {
+			return false, nil
+		}
+		if _, err := fn.Exec.Query(iptables, append([]string{"-C"}, t.jump()...)...); err != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// jump is the FORWARD rule that jumps to the isolation chain.
+func (t *IPTables) jump() []string {
+	return []string{"FORWARD", "-m", "comment", "--comment", t.comment, "-j", t.chain}
+}
+
+// masqueradeRule returns the command and the POSTROUTING rule of m.
+func (t *IPTables) masqueradeRule(m *Masquerade) (string, []string) {
+	iptables := "iptables"
+	if isIPv6(m.CIDR) {
+		iptables = "ip6tables"
+	}
+	return iptables, []string{"POSTROUTING", "-s", m.CIDR, "!", "-o", m.Device, "-m", "comment", "--comment", t.comment, "-j", "MASQUERADE"}
+}
+
+func (t *IPTables) masquerade(m *Masquerade) error {
+	iptables, rule := t.masqueradeRule(m)
+	if _, err := fn.Exec.Query(iptables, append([]string{"-t", "nat", "-C"}, rule...)...); err == nil {
+		return nil
+	}
+	cmdout, err := fn.Exec.Run(iptables, append([]string{"-t", "nat", "-A"}, rule...)...)
+	if err != nil {
+		return fmt.Errorf("failed to set POSTROUTING: %s. cmdout: %s", err, cmdout)
+	}
+	return nil
+}
+
+// Remove deletes the masquerade rules and the isolation chains with their
+// jumps.
+func (t *IPTables) Remove(rules *Rules) error {
+	for _, m := range rules.Masquerades {
+		iptables, rule := t.masqueradeRule(m)
+		if _, err := fn.Exec.Query(iptables, append([]string{"-t", "nat", "-C"}, rule...)...); err != nil {
+			continue
+		}
+		cmdout, err := fn.Exec.Run(iptables, append([]string{"-t", "nat", "-D"}, rule...)...)
+		if err != nil {
+			return fmt.Errorf("failed to delete POSTROUTING rule. rule: %v. cmdout: %s. error: %v", rule, cmdout, err)
+		}
+	}
+
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		if err := t.removeIsolation(iptables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIsolation deletes the isolation chain of iptables and its jump, if
+// they exist.
+func (t *IPTables) removeIsolation(iptables string) error {
+	if _, err := fn.Exec.Query(iptables, append([]string{"-C"}, t.jump()...)...); err == nil {
+		cmdout, err := fn.Exec.Run(iptables, append([]string{"-D"}, t.jump()...)...)
+		if err != nil {
+			return fmt.Errorf("failed to delete jump to %v chain. cmdout: %s. error: %v", t.chain, cmdout, err)
+		}
+	}
+	if _, err := fn.Exec.Query(iptables, "-S", t.chain); err != nil {
+		return nil
+	}
+	for _, op := range []string{"-F", "-X"} {
+		cmdout, err := fn.Exec.Run(iptables, op, t.chain)
+		if err != nil {
+			return fmt.Errorf("failed to delete %v chain. cmdout: %s. error: %v", t.chain, cmdout, err)
+		}
+	}
+	return nil
+}
+
+// isolate rebuilds the isolation chain of iptables with the IPv4 drops and
+// the one of ip6tables with the IPv6 drops. A family without drops has its
+// chain removed, so ip6tables is not needed on IPv4 only hosts.
+func (t *IPTables) isolate(drops []*Drop) error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		rules := t.isolationRules(drops, iptables == "ip6tables")
+		if rules == nil {
+			if err := t.removeIsolation(iptables); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := t.rebuild(iptables, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *IPTables) rebuild(iptables string, rules [][]string) error {
+	// -S fails unless the chain exists.
+	if _, err := fn.Exec.Query(iptables, "-S", t.chain); err != nil {
+		cmdout, err := fn.Exec.Run(iptables, "-N", t.chain)
+		if err != nil {
+			return fmt.Errorf("failed to create %v chain. cmdout: %s. error: %v", t.chain, cmdout, err)
+		}
+	}
+
+	cmdout, err := fn.Exec.Run(iptables, "-F", t.chain)
+	if err != nil {
+		return fmt.Errorf("failed to flush %v chain. cmdout: %s. error: %v", t.chain, cmdout, err)
+	}
+
+	for _, rule := range rules {
+		cmdout, err = fn.Exec.Run(iptables, append([]string{"-A", t.chain}, rule...)...)
+		if err != nil {
+			return fmt.Errorf("failed to add %v rule. rule: %v. cmdout: %s. error: %v", t.chain, rule, cmdout, err)
+		}
+	}
+
+	if _, err = fn.Exec.Query(iptables, append([]string{"-C"}, t.jump()...)...); err != nil {
+		cmdout, err = fn.Exec.Run(iptables, append([]string{"-I"}, t.jump()...)...)
+		if err != nil {
+			return fmt.Errorf("failed to jump to %v chain. cmdout: %s. error: %v", t.chain, cmdout, err)
+		}
+	}
+	return nil
+}
+
+// isolationRules returns the rules of the isolation chain for the drops of
+// one family, or nil if it has none.
+func (t *IPTables) isolationRules(drops []*Drop, ipv6 bool) [][]string {
+	var rules [][]string
+	for _, drop := range drops {
+		if isIPv6(drop.Src) != ipv6 {
+			continue
+		}
+		rules = append(rules, []string{"-s", drop.Src, "-d", drop.Dst, "-j", "DROP"})
+	}
+	if rules == nil {
+		return nil
+	}
+	return append([][]string{{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}}, rules...)
+}
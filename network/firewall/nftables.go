@@ -0,0 +1,96 @@
+package firewall
+
+import (
+	"container-network/fn"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+func NewNFTables() *NFTables {
+	return &NFTables{table: "inet container-network"}
+}
+
+// NFTables keeps every rule in its own table. Apply replaces the whole table
+// in a single nft transaction, so the rules are never half applied and no
+// other table is touched. The table comment holds a digest of the rules, so
+// Installed does not have to parse nft's rendering of them.
+type NFTables struct {
+	table string
+}
+
+func (t *NFTables) Apply(rules *Rules) error {
+	ruleset := t.ruleset(rules)
+	cmdout, err := fn.Exec.Run("nft", ruleset)
+	if err != nil {
+		return fmt.Errorf("failed to apply nftables ruleset. ruleset: %v. cmdout: %s. error: %v", ruleset, cmdout, err)
+	}
+	return nil
+}
+
+func (t *NFTables) Installed(rules *Rules) (bool, error) {
+	cmdout, err := fn.Exec.Query("nft", "list", "table", t.table)
+	if err != nil {
+		// The table does not exist.
+		return false, nil
+	}
+	return fn.MatchCMDOut(cmdout, fmt.Sprintf("comment %q", digest(t.chains(rules)))), nil
+}
+
+// Remove deletes the table, creating it first so a missing table is not an error.
+func (t *NFTables) Remove(rules *Rules) error {
+	ruleset := fmt.Sprintf("add table %v\ndelete table %v\n", t.table, t.table)
+	cmdout, err := fn.Exec.Run("nft", ruleset)
+	if err != nil {
+		return fmt.Errorf("failed to delete nftables table. table: %v. cmdout: %s. error: %v", t.table, cmdout, err)
+	}
+	return nil
+}
+
+// ruleset creates the table if needed, so it can be deleted, and recreates it.
+func (t *NFTables) ruleset(rules *Rules) string {
+	chains := t.chains(rules)
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %v\n", t.table)
+	fmt.Fprintf(&b, "delete table %v\n", t.table)
+	fmt.Fprintf(&b, "table %v {\n", t.table)
+	fmt.Fprintf(&b, "\tcomment %q\n", digest(chains))
+	b.WriteString(chains)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (t *NFTables) chains(rules *Rules) string {
+	var b strings.Builder
+
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	for _, m := range rules.Masquerades {
+		fmt.Fprintf(&b, "\t\t%v saddr %v oifname != %q masquerade\n", family(m.CIDR), m.CIDR, m.Device)
+	}
+	b.WriteString("\t}\n")
+
+	if len(rules.Drops) > 0 {
+		b.WriteString("\tchain forward {\n")
+		b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+		b.WriteString("\t\tct state established,related return\n")
+		for _, drop := range rules.Drops {
+			fmt.Fprintf(&b, "\t\t%v saddr %v %v daddr %v drop\n", family(drop.Src), drop.Src, family(drop.Dst), drop.Dst)
+		}
+		b.WriteString("\t}\n")
+	}
+	return b.String()
+}
+
+func digest(chains string) string {
+	sum := sha256.Sum256([]byte(chains))
+	return hex.EncodeToString(sum[:8])
+}
+
+func family(cidr string) string {
+	if isIPv6(cidr) {
+		return "ip6"
+	}
+	return "ip"
+}
@@ -0,0 +1,182 @@
+package geneve
+
+import (
+	"container-network/cluster"
+	"container-network/containerd"
+	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+)
+
+func init() {
+	driver.Register("geneve", func() driver.Driver { return New() })
+}
+
+func New() *GENEVE {
+	return &GENEVE{
+		vni:        100,
+		dstport:    6081,
+		ttl:        64,
+		macs:       map[string]string{},
+		containers: map[string][]*containerd.Container{},
+	}
+}
+
+// GENEVE creates one point-to-point geneve link per peer. All links on a node
+// share the same MAC, which peers learn through /geneve/mac and use as the
+// lladdr of the neighbor entries for our containers.
+type GENEVE struct {
+	driver.Peers
+	vni     int
+	dstport int
+	ttl     int
+	// macs holds the geneve MAC learned from each peer, keyed by node IP.
+	macs map[string]string
+	// containers holds the containers last fetched from each peer, keyed by node IP.
+	containers map[string][]*containerd.Container
+}
+
+func (g *GENEVE) Init() error {
+	current := cluster.Instance.Current
+	if current.GENEVE == nil {
+		current.GENEVE = &cluster.GENEVE{}
+	}
+	if current.GENEVE.VNI > 0 {
+		g.vni = current.GENEVE.VNI
+	}
+	if current.GENEVE.DstPort > 0 {
+		g.dstport = current.GENEVE.DstPort
+	}
+	if current.GENEVE.TTL > 0 {
+		g.ttl = current.GENEVE.TTL
+	}
+	if len(current.GENEVE.MAC) == 0 {
+		mac, err := macFromIP(current.IP)
+		if err != nil {
+			return err
+		}
+		current.GENEVE.MAC = mac
+	}
+	return nil
+}
+
+// RemoveNode also drops the geneve MAC and the containers fetched from the
+// peer.
+func (g *GENEVE) RemoveNode(node *cluster.Node) error {
+	delete(g.macs, node.IP)
+	delete(g.containers, node.IP)
+	return g.Peers.RemoveNode(node)
+}
+
+// Reconcile refreshes what the driver knows about the peers. A peer that
+// cannot be reached keeps its last known containers and MAC.
+func (g *GENEVE) Reconcile(ctx context.Context) error {
+	for _, node := range g.Nodes() {
+		containers, err := cluster.Instance.GetContainers(ctx, node.IP)
+		if err != nil {
+			fn.Errorf("failed to get containers. node: %v. error: %v", node, err)
+		} else {
+			g.containers[node.IP] = containers
+		}
+		mac, err := cluster.Instance.GetGENEVEMAC(ctx, node.IP)
+		if err != nil {
+			fn.Errorf("failed to get geneve mac. node: %v. error: %v", node, err)
+			continue
+		}
+		g.macs[node.IP] = mac
+	}
+	return nil
+}
+
+// Desired returns, for every peer, its geneve link, the routes to its CIDRs
+// and, once its MAC is known, the neighbor entries of its containers.
+func (g *GENEVE) Desired() []reconcile.Object {
+	objs := []reconcile.Object{}
+	for _, node := range g.Nodes() {
+		name := linkName(node)
+		remote := node.IP
+		objs = append(objs, &reconcile.Link{Name: name, Add: func() error {
+			return nl.AddGENEVE(name, cluster.Instance.Current.GENEVE.MAC, g.vni, remote, g.dstport, g.ttl)
+		}})
+		for _, cidr := range []string{node.Container.CIDR, node.Container.CIDR6} {
+			if len(cidr) > 0 {
+				objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: cidr, Dev: name}})
+			}
+		}
+		mac, ok := g.macs[node.IP]
+		if !ok {
+			continue
+		}
+		for _, container := range g.containers[node.IP] {
+			if container.Network != cluster.DefaultNetwork {
+				continue
+			}
+			for _, ip := range []string{container.IP, container.IP6} {
+				if len(ip) > 0 {
+					objs = append(objs, &reconcile.Neigh{IP: ip, MAC: mac, Dev: name})
+				}
+			}
+		}
+	}
+	return objs
+}
+
+// Scope has the collector delete the links of departed peers, and the stale
+// routes and neighbor entries on the links of the current ones.
+func (g *GENEVE) Scope() reconcile.Scope {
+	scope := reconcile.Scope{LinkPrefixes: []string{"gnv"}}
+	for _, node := range g.Nodes() {
+		scope.Devices = append(scope.Devices, linkName(node))
+	}
+	return scope
+}
+
+// Cleanup deletes the geneve links the daemon created. Mgr has already
+// removed the objects of Desired, so this only catches links left over.
+func (g *GENEVE) Cleanup() error {
+	for _, node := range g.Nodes() {
+		name := linkName(node)
+		owned, err := reconcile.OwnsLink(name)
+		if err != nil {
+			return fmt.Errorf("failed to read geneve link. node: %v. error: %v", node, err)
+		}
+		if !owned {
+			continue
+		}
+		if err := nl.DelLink(name); err != nil && !nl.IsNotExist(err) {
+			return fmt.Errorf("failed to delete geneve link. node: %v. error: %v", node, err)
+		}
+	}
+	return nil
+}
+
+// linkName derives a per-peer link name from the node IP, e.g. gnvc0a8f5ac.
+// An IPv6 address does not fit, and has colons, so it is hashed instead.
+func linkName(node *cluster.Node) string {
+	ip := net.ParseIP(node.IP)
+	if ip.To4() != nil {
+		return fmt.Sprintf("gnv%x", []byte(ip.To4()))
+	}
+	return fmt.Sprintf("gnv%x", sha1.Sum(ip))[:15]
+}
+
+// macFromIP derives a locally administered MAC from the node IP, so it stays
+// stable across restarts without being persisted. An IPv6 node IP is hashed
+// down to the 4 bytes.
+func macFromIP(nodeIP string) (string, error) {
+	parsed := net.ParseIP(nodeIP)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid node IP: %v", nodeIP)
+	}
+	ip := parsed.To4()
+	if ip == nil {
+		sum := sha1.Sum(parsed)
+		ip = sum[:4]
+	}
+	return net.HardwareAddr{0x0e, 0x00, ip[0], ip[1], ip[2], ip[3]}.String(), nil
+}
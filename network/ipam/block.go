@@ -0,0 +1,290 @@
+package ipam
+
+import (
+	"container-network/cluster"
+	"container-network/fn"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Blocks is the block store of the node. Mgr opens it before the node claims
+// its block. Until then blocks are only kept in memory.
+var Blocks = &BlockStore{blocks: map[string]*cluster.Block{}, proposals: map[string]*proposal{}}
+
+// OpenBlocks loads the blocks persisted at path. An empty path keeps them in
+// memory only.
+func OpenBlocks(path string) (*BlockStore, error) {
+	s := &BlockStore{path: path, blocks: map[string]*cluster.Block{}, proposals: map[string]*proposal{}}
+	if len(path) == 0 {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	blocks := []*cluster.Block{}
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	for _, block := range blocks {
+		s.blocks[block.Node] = block
+	}
+	return s, nil
+}
+
+// BlockStore keeps the blocks of the pool claimed by the nodes the node knows
+// of, its own included, keyed by node IP. A node holds one block.
+type BlockStore struct {
+	path   string
+	blocks map[string]*cluster.Block
+	// proposals holds the blocks proposed by a node and not committed yet,
+	// keyed by node IP. They are only kept in memory.
+	proposals map[string]*proposal
+	sync.Mutex
+}
+
+// ProposalTTL is how long a proposed block that is not committed keeps other
+// nodes from proposing an overlapping one.
+const ProposalTTL = 10 * time.Second
+
+type proposal struct {
+	block   *cluster.Block
+	expires time.Time
+}
+
+// ErrClaimed is returned for a claim of a block that overlaps the block of
+// another node.
+var ErrClaimed = errors.New("block claimed by another node")
+
+// Propose accepts the block a node proposes, without recording it, unless it
+// overlaps the block of another node or a block another node proposed. The
+// proposal replaces the earlier one of the node and expires after
+// ProposalTTL unless Claim commits it.
+func (s *BlockStore) Propose(block *cluster.Block) error {
+	_, ipNet, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for node, p := range s.proposals {
+		if now.After(p.expires) {
+			delete(s.proposals, node)
+		}
+	}
+	others := []*cluster.Block{}
+	for _, other := range s.blocks {
+		others = append(others, other)
+	}
+	for _, p := range s.proposals {
+		others = append(others, p.block)
+	}
+	for _, other := range others {
+		if other.Node == block.Node {
+			continue
+		}
+		_, otherNet, err := net.ParseCIDR(other.CIDR)
+		if err != nil {
+			continue
+		}
+		if overlaps(ipNet, otherNet) {
+			return fmt.Errorf("%w. cidr: %v. node: %v", ErrClaimed, other.CIDR, other.Node)
+		}
+	}
+	b := *block
+	s.proposals[block.Node] = &proposal{block: &b, expires: now.Add(ProposalTTL)}
+	return nil
+}
+
+// Withdraw drops the proposal of the node.
+func (s *BlockStore) Withdraw(node string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.proposals, node)
+}
+
+// Claim records the block of a node, replacing the one it held before, and
+// drops its proposal.
+func (s *BlockStore) Claim(block *cluster.Block) error {
+	_, ipNet, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, other := range s.blocks {
+		if other.Node == block.Node {
+			continue
+		}
+		_, otherNet, err := net.ParseCIDR(other.CIDR)
+		if err != nil {
+			continue
+		}
+		if overlaps(ipNet, otherNet) {
+			return fmt.Errorf("%w. cidr: %v. node: %v", ErrClaimed, other.CIDR, other.Node)
+		}
+	}
+	delete(s.proposals, block.Node)
+	if old, ok := s.blocks[block.Node]; ok && old.CIDR == block.CIDR {
+		return nil
+	}
+	old, replaced := s.blocks[block.Node]
+	b := *block
+	s.blocks[block.Node] = &b
+	if err := s.save(); err != nil {
+		if replaced {
+			s.blocks[block.Node] = old
+		} else {
+			delete(s.blocks, block.Node)
+		}
+		return fmt.Errorf("failed to save block. node: %v. error: %v", block.Node, err)
+	}
+	return nil
+}
+
+// Of returns the block of the node, or nil.
+func (s *BlockStore) Of(node string) *cluster.Block {
+	s.Lock()
+	defer s.Unlock()
+	block, ok := s.blocks[node]
+	if !ok {
+		return nil
+	}
+	b := *block
+	return &b
+}
+
+// List returns the blocks sorted by CIDR.
+func (s *BlockStore) List() []*cluster.Block {
+	s.Lock()
+	defer s.Unlock()
+	return s.sorted()
+}
+
+// Next returns the first block of the pool that overlaps neither a known
+// block nor one of the CIDRs taken.
+func (s *BlockStore) Next(pool *cluster.Pool, taken []string) (string, error) {
+	_, poolNet, err := net.ParseCIDR(pool.CIDR)
+	if err != nil {
+		return "", err
+	}
+	if poolNet.IP.To4() == nil {
+		return "", fmt.Errorf("pool %v is not IPv4", pool.CIDR)
+	}
+	ones, bits := poolNet.Mask.Size()
+	if pool.NodeSize < ones || pool.NodeSize > bits-2 {
+		return "", fmt.Errorf("invalid node size %v for pool %v", pool.NodeSize, pool.CIDR)
+	}
+
+	s.Lock()
+	used := []*net.IPNet{}
+	for _, block := range s.blocks {
+		taken = append(taken, block.CIDR)
+	}
+	s.Unlock()
+	for _, cidr := range taken {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			used = append(used, ipNet)
+		}
+	}
+
+	mask := net.CIDRMask(pool.NodeSize, bits)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-pool.NodeSize))
+	for ip := poolNet.IP.Mask(poolNet.Mask); poolNet.Contains(ip); ip = addIP(ip, step) {
+		block := &net.IPNet{IP: ip, Mask: mask}
+		free := true
+		for _, ipNet := range used {
+			if overlaps(block, ipNet) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return block.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no free block in pool %v", pool.CIDR)
+}
+
+func (s *BlockStore) sorted() []*cluster.Block {
+	blocks := make([]*cluster.Block, 0, len(s.blocks))
+	for _, block := range s.blocks {
+		b := *block
+		blocks = append(blocks, &b)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].CIDR < blocks[j].CIDR })
+	return blocks
+}
+
+func (s *BlockStore) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fn.WriteFileAtomic(s.path, data)
+}
+
+// Assign configures the node with its block: the block as container CIDR,
+// its first host address as gateway and, unless one inside the block is
+// configured, its network address as vxlan address.
+func Assign(node *cluster.Node, block *cluster.Block) error {
+	_, ipNet, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return err
+	}
+	if node.Container == nil {
+		node.Container = &cluster.Container{}
+	}
+	node.Container.CIDR = block.CIDR
+	node.Container.Gateway = addIP(ipNet.IP, big.NewInt(1)).String()
+	if node.VXLAN == nil {
+		node.VXLAN = &cluster.VXLAN{}
+	}
+	if ip := net.ParseIP(node.VXLAN.IP); ip == nil || !ipNet.Contains(ip) {
+		node.VXLAN.IP = ipNet.IP.String()
+	}
+	return nil
+}
+
+// Overlap reports whether the CIDRs a and b share an address. An invalid
+// CIDR overlaps nothing.
+func Overlap(a string, b string) bool {
+	_, aNet, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, bNet, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+	return overlaps(aNet, bNet)
+}
+
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// addIP returns ip + n. It wraps around past the last address.
+func addIP(ip net.IP, n *big.Int) net.IP {
+	sum := new(big.Int).Add(new(big.Int).SetBytes(ip), n)
+	bys := sum.Bytes()
+	out := make(net.IP, len(ip))
+	if len(bys) > len(out) {
+		bys = bys[len(bys)-len(out):]
+	}
+	copy(out[len(out)-len(bys):], bys)
+	return out
+}
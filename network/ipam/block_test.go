@@ -0,0 +1,224 @@
+package ipam
+
+import (
+	"container-network/cluster"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    *cluster.Pool
+		blocks  []*cluster.Block
+		taken   []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "empty pool",
+			pool: &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 24},
+			want: "10.244.0.0/24",
+		},
+		{
+			name:   "known blocks skipped",
+			pool:   &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 24},
+			blocks: []*cluster.Block{{CIDR: "10.244.0.0/24", Node: "a"}, {CIDR: "10.244.1.0/24", Node: "b"}},
+			want:   "10.244.2.0/24",
+		},
+		{
+			name:  "configured CIDR wider than a block",
+			pool:  &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 24},
+			taken: []string{"10.244.0.0/23"},
+			want:  "10.244.2.0/24",
+		},
+		{
+			name:  "configured CIDR inside a block",
+			pool:  &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 24},
+			taken: []string{"10.244.0.128/25"},
+			want:  "10.244.1.0/24",
+		},
+		{
+			name:  "configured CIDR outside the pool",
+			pool:  &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 24},
+			taken: []string{"172.18.10.0/24"},
+			want:  "10.244.0.0/24",
+		},
+		{
+			name:    "pool full",
+			pool:    &cluster.Pool{CIDR: "10.244.0.0/23", NodeSize: 24},
+			blocks:  []*cluster.Block{{CIDR: "10.244.0.0/24", Node: "a"}},
+			taken:   []string{"10.244.1.0/24"},
+			wantErr: true,
+		},
+		{
+			name:    "node size wider than the pool",
+			pool:    &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 15},
+			wantErr: true,
+		},
+		{
+			name:    "node size without hosts",
+			pool:    &cluster.Pool{CIDR: "10.244.0.0/16", NodeSize: 31},
+			wantErr: true,
+		},
+		{
+			name:    "IPv6 pool",
+			pool:    &cluster.Pool{CIDR: "fd00::/48", NodeSize: 64},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenBlocks("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, block := range tt.blocks {
+				if err := s.Claim(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := s.Next(tt.pool, tt.taken)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Next() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProposeAndClaim(t *testing.T) {
+	block := func(cidr string, node string) *cluster.Block {
+		return &cluster.Block{CIDR: cidr, Node: node}
+	}
+	tests := []struct {
+		name string
+		// claimed and proposed are recorded before the step.
+		claimed  []*cluster.Block
+		proposed []*cluster.Block
+		// expired proposals are past ProposalTTL.
+		expired bool
+		// commit claims the block instead of proposing it.
+		commit  bool
+		block   *cluster.Block
+		wantErr error
+	}{
+		{
+			name:  "free block",
+			block: block("10.244.0.0/24", "a"),
+		},
+		{
+			name:    "block of another node",
+			claimed: []*cluster.Block{block("10.244.0.0/24", "b")},
+			block:   block("10.244.0.0/24", "a"),
+			wantErr: ErrClaimed,
+		},
+		{
+			name:    "block overlapping the block of another node",
+			claimed: []*cluster.Block{block("10.244.0.0/23", "b")},
+			block:   block("10.244.1.0/24", "a"),
+			wantErr: ErrClaimed,
+		},
+		{
+			name:     "block proposed by another node",
+			proposed: []*cluster.Block{block("10.244.0.0/24", "b")},
+			block:    block("10.244.0.0/24", "a"),
+			wantErr:  ErrClaimed,
+		},
+		{
+			name:     "expired proposal of another node",
+			proposed: []*cluster.Block{block("10.244.0.0/24", "b")},
+			expired:  true,
+			block:    block("10.244.0.0/24", "a"),
+		},
+		{
+			name:     "proposal of the same node replaced",
+			proposed: []*cluster.Block{block("10.244.0.0/24", "a")},
+			block:    block("10.244.1.0/24", "a"),
+		},
+		{
+			name:    "block of the same node replaced",
+			claimed: []*cluster.Block{block("10.244.0.0/24", "a")},
+			block:   block("10.244.1.0/24", "a"),
+		},
+		{
+			name:     "commit over the proposal of another node",
+			proposed: []*cluster.Block{block("10.244.0.0/24", "b")},
+			commit:   true,
+			block:    block("10.244.0.0/24", "a"),
+		},
+		{
+			name:    "commit of the block of another node",
+			claimed: []*cluster.Block{block("10.244.0.0/24", "b")},
+			commit:  true,
+			block:   block("10.244.0.0/24", "a"),
+			wantErr: ErrClaimed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenBlocks("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range tt.claimed {
+				if err := s.Claim(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, b := range tt.proposed {
+				if err := s.Propose(b); err != nil {
+					t.Fatal(err)
+				}
+				if tt.expired {
+					s.proposals[b.Node].expires = time.Now().Add(-time.Second)
+				}
+			}
+			if tt.commit {
+				err = s.Claim(tt.block)
+			} else {
+				err = s.Propose(tt.block)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			// A proposal is never recorded as a block, a commit is.
+			got := s.Of(tt.block.Node)
+			committed := tt.commit && tt.wantErr == nil
+			if committed && (got == nil || got.CIDR != tt.block.CIDR) {
+				t.Errorf("Of(%v) = %v, want %v", tt.block.Node, got, tt.block.CIDR)
+			}
+			if !committed && got != nil && got.CIDR == tt.block.CIDR {
+				t.Errorf("Of(%v) = %v, want the proposal left out", tt.block.Node, got.CIDR)
+			}
+		})
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want bool
+	}{
+		{"10.244.0.0/24", "10.244.0.0/24", true},
+		{"10.244.0.0/16", "10.244.3.0/24", true},
+		{"10.244.3.0/24", "10.244.0.0/16", true},
+		{"10.244.0.0/24", "10.244.1.0/24", false},
+		{"10.244.0.0/24", "invalid", false},
+	}
+	for _, tt := range tests {
+		if got := Overlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("Overlap(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
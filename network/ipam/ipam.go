@@ -3,25 +3,320 @@ package ipam
 import (
 	"container-network/cluster"
 	"container-network/containerd"
+	"container-network/fn"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
-var locker sync.Locker = &sync.Mutex{}
+// Instance is the allocation store of the node. Mgr opens it before anything
+// is allocated. Until then leases are only kept in memory.
+var Instance = &Store{leases: map[string]*Lease{}, released: map[string]time.Time{}}
 
-func FindAvailableIP() (string, error) {
-	locker.Lock()
-	defer locker.Unlock()
+// Lease holds the addresses allocated to a container.
+type Lease struct {
+	Container string `json:"container"`
+	// ID is the runtime container ID of a container added through CNI.
+	ID        string    `json:"id,omitempty"`
+	Network   string    `json:"network"`
+	IP        string    `json:"ip,omitempty"`
+	IP6       string    `json:"ip6,omitempty"`
+	Allocated time.Time `json:"allocated"`
+	// Owner is the IP of the node that allocated the lease.
+	Owner string `json:"owner"`
+}
+
+// Release is the last time an address was released.
+type Release struct {
+	IP       string    `json:"ip"`
+	Released time.Time `json:"released"`
+}
+
+// state is the content of the store file.
+type state struct {
+	Leases       []*Lease               `json:"leases"`
+	Reservations []*cluster.Reservation `json:"reservations"`
+	Released     []*Release             `json:"released"`
+}
+
+// Open loads the leases, reservations and releases persisted at path. An
+// empty path keeps them in memory only. A released address is not handed out
+// again before quarantine has passed.
+func Open(path string, quarantine time.Duration) (*Store, error) {
+	s := &Store{path: path, leases: map[string]*Lease{}, released: map[string]time.Time{}, quarantine: quarantine}
+	if len(path) == 0 {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st := &state{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	for _, lease := range st.Leases {
+		s.leases[lease.Container] = lease
+	}
+	s.reservations = st.Reservations
+	for _, release := range st.Released {
+		s.released[release.IP] = release.Released
+	}
+	return s, nil
+}
+
+// Store keeps the leases of the node, keyed by container name, and the
+// reservations made through the API. Every change is written to disk before
+// it is handed out, so an address is never allocated twice, even across a crash.
+type Store struct {
+	path   string
+	leases map[string]*Lease
+	// reservations are the reservations made through the API. The ones of
+	// the config are read from the networks.
+	reservations []*cluster.Reservation
+	// released holds when the addresses that are not leased were released.
+	// Allocation skips the ones released within quarantine and prefers the
+	// ones released the longest ago, so traffic still heading for a dead
+	// container does not reach its successor.
+	released   map[string]time.Time
+	quarantine time.Duration
+	sync.Mutex
+}
+
+// Allocate returns the lease of the container on the network, allocating
+// one if it has none. A reserved address goes to the container of the
+// reservation and to no one else, even within its quarantine.
+func (s *Store) Allocate(name string, network *cluster.Network) (*Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if lease, ok := s.leases[name]; ok && lease.Network == network.Name {
+		l := *lease
+		return &l, nil
+	}
+
+	lease := &Lease{Container: name, Network: network.Name, Allocated: time.Now(), Owner: cluster.Instance.Current.IP}
+	current := network.Container
+	reservation := s.reservation(name, network)
+	// A pattern reserves its address for the first matching container only,
+	// the others get a dynamic address.
+	if reservation != nil && reservation.Container != name && s.leasedToOther(reservation, name) {
+		fn.Infof("reserved address of %v already leased, allocating one. container: %v", reservation.Container, name)
+		reservation = nil
+	}
+	if len(current.CIDR) > 0 {
+		if reservation != nil && len(reservation.IP) > 0 {
+			if err := s.reserved(name, reservation.IP, current.CIDR, current.Gateway); err != nil {
+				return nil, err
+			}
+			lease.IP = reservation.IP
+		} else {
+			ip, err := s.findAvailableIP(current.CIDR, s.usedIP(name, network))
+			if err != nil {
+				return nil, fmt.Errorf("failed to find available ip: %v", err)
+			}
+			lease.IP = ip
+		}
+	}
+	if len(current.CIDR6) > 0 {
+		if reservation != nil && len(reservation.IP6) > 0 {
+			if err := s.reserved(name, reservation.IP6, current.CIDR6, current.Gateway6); err != nil {
+				return nil, err
+			}
+			lease.IP6 = reservation.IP6
+		} else {
+			usedIP, err := s.usedIP6(name, network)
+			if err != nil {
+				return nil, err
+			}
+			ip6, err := s.findAvailableIP(current.CIDR6, usedIP)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find available ipv6: %v", err)
+			}
+			lease.IP6 = ip6
+		}
+	}
+
+	old, replaced := s.leases[name]
+	s.leases[name] = lease
+	released := s.take(lease.IP, lease.IP6)
+	if err := s.save(); err != nil {
+		if replaced {
+			s.leases[name] = old
+		} else {
+			delete(s.leases, name)
+		}
+		for ip, at := range released {
+			s.released[ip] = at
+		}
+		return nil, fmt.Errorf("failed to save lease. container: %v. error: %v", name, err)
+	}
+	l := *lease
+	return &l, nil
+}
+
+// Adopt records the addresses found on a container that has no lease, e.g.
+// one configured before the store existed. Like Allocate, it takes them out
+// of quarantine.
+func (s *Store) Adopt(name string, network string, ip string, ip6 string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.leases[name]; ok {
+		return nil
+	}
+	s.leases[name] = &Lease{Container: name, Network: network, IP: ip, IP6: ip6, Allocated: time.Now(), Owner: cluster.Instance.Current.IP}
+	released := s.take(ip, ip6)
+	if err := s.save(); err != nil {
+		delete(s.leases, name)
+		for ip, at := range released {
+			s.released[ip] = at
+		}
+		return fmt.Errorf("failed to save lease. container: %v. error: %v", name, err)
+	}
+	return nil
+}
+
+// Release frees the addresses of the container. They go into quarantine.
+func (s *Store) Release(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	lease, ok := s.leases[name]
+	if !ok {
+		return nil
+	}
+	delete(s.leases, name)
+	now := time.Now()
+	released := map[string]time.Time{}
+	for _, ip := range []string{lease.IP, lease.IP6} {
+		if len(ip) == 0 {
+			continue
+		}
+		if at, ok := s.released[ip]; ok {
+			released[ip] = at
+		}
+		s.released[ip] = now
+	}
+	if err := s.save(); err != nil {
+		s.leases[name] = lease
+		for _, ip := range []string{lease.IP, lease.IP6} {
+			delete(s.released, ip)
+		}
+		for ip, at := range released {
+			s.released[ip] = at
+		}
+		return fmt.Errorf("failed to release lease. container: %v. error: %v", name, err)
+	}
+	return nil
+}
+
+// take forgets the release of the addresses leased again and returns the
+// forgotten releases.
+func (s *Store) take(ips ...string) map[string]time.Time {
+	taken := map[string]time.Time{}
+	for _, ip := range ips {
+		if at, ok := s.released[ip]; ok {
+			taken[ip] = at
+			delete(s.released, ip)
+		}
+	}
+	return taken
+}
+
+// SetID records the runtime ID of the container on its lease, so CNI CHECK
+// and DEL find the container after a restart.
+func (s *Store) SetID(name string, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	lease, ok := s.leases[name]
+	if !ok {
+		return fmt.Errorf("no lease. container: %v", name)
+	}
+	if lease.ID == id {
+		return nil
+	}
+	old := lease.ID
+	lease.ID = id
+	if err := s.save(); err != nil {
+		lease.ID = old
+		return fmt.Errorf("failed to save lease. container: %v. error: %v", name, err)
+	}
+	return nil
+}
+
+// Get returns the lease of the container.
+func (s *Store) Get(name string) (*Lease, bool) {
+	s.Lock()
+	defer s.Unlock()
+	lease, ok := s.leases[name]
+	if !ok {
+		return nil, false
+	}
+	l := *lease
+	return &l, true
+}
+
+// ByID returns the lease of the container with the runtime ID.
+func (s *Store) ByID(id string) (*Lease, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, lease := range s.leases {
+		if lease.ID == id {
+			l := *lease
+			return &l, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the leases sorted by container name.
+func (s *Store) List() []*Lease {
+	s.Lock()
+	defer s.Unlock()
+	return s.sorted()
+}
+
+func (s *Store) sorted() []*Lease {
+	leases := make([]*Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		l := *lease
+		leases = append(leases, &l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Container < leases[j].Container })
+	return leases
+}
 
-	_, ipNet, err := net.ParseCIDR(cluster.Instance.Current.Container.CIDR)
+func (s *Store) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	released := make([]*Release, 0, len(s.released))
+	for ip, at := range s.released {
+		released = append(released, &Release{IP: ip, Released: at})
+	}
+	sort.Slice(released, func(i, j int) bool { return released[i].IP < released[j].IP })
+	data, err := json.MarshalIndent(&state{Leases: s.sorted(), Reservations: s.reservations, Released: released}, "", "  ")
 	if err != nil {
-		return "", err
+		return err
 	}
+	return fn.WriteFileAtomic(s.path, data)
+}
 
+// usedIP returns the IPv4 addresses taken on the node, besides the one of
+// the container itself: the leases, the reservations, the gateway, the vxlan
+// device and the containers that have not been adopted yet.
+func (s *Store) usedIP(name string, network *cluster.Network) map[string]struct{} {
 	usedIP := map[string]struct{}{
-		cluster.Instance.Current.VXLAN.IP:          {},
-		cluster.Instance.Current.Container.Gateway: {},
+		network.Container.Gateway: {},
+	}
+	if network.VXLAN != nil {
+		usedIP[network.VXLAN.IP] = struct{}{}
 	}
 
 	// _, ipv4Net, _ := net.ParseCIDR(cluster.Instance.Current.VXLAN.IP)
@@ -29,18 +324,104 @@ func FindAvailableIP() (string, error) {
 	// 	usedIP[ip.String()] = struct{}{}
 	// }
 
-	for _, container := range containerd.Instance.Containers {
-		usedIP[container.IP] = struct{}{}
+	for _, lease := range s.leases {
+		if lease.Container != name {
+			usedIP[lease.IP] = struct{}{}
+		}
+	}
+	for _, reservation := range s.reservationsOf(network) {
+		usedIP[reservation.IP] = struct{}{}
+	}
+	for _, container := range containerd.Instance.List() {
+		if container.Name != name {
+			usedIP[container.IP] = struct{}{}
+		}
+	}
+	return usedIP
+}
+
+func (s *Store) usedIP6(name string, network *cluster.Network) (map[string]struct{}, error) {
+	_, ipNet, err := net.ParseCIDR(network.Container.CIDR6)
+	if err != nil {
+		return nil, err
+	}
+
+	usedIP := map[string]struct{}{
+		// The subnet-router anycast address.
+		ipNet.IP.String():          {},
+		network.Container.Gateway6: {},
 	}
 
+	for _, lease := range s.leases {
+		if lease.Container != name {
+			usedIP[lease.IP6] = struct{}{}
+		}
+	}
+	for _, reservation := range s.reservationsOf(network) {
+		usedIP[reservation.IP6] = struct{}{}
+	}
+	for _, container := range containerd.Instance.List() {
+		if container.Name != name {
+			usedIP[container.IP6] = struct{}{}
+		}
+	}
+	return usedIP, nil
+}
+
+// findAvailableIP returns the free address of cidr that was released the
+// longest ago. An address never released comes first, the lowest one.
+// Addresses released within the quarantine are not free.
+func (s *Store) findAvailableIP(cidr string, usedIP map[string]struct{}) (string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	found, foundAt, quarantined := "", time.Time{}, 0
 	for ip := ipNet.IP.Mask(ipNet.Mask); ipNet.Contains(ip); incrementIP(ip) {
+		if !isHost(ipNet, ip) {
+			continue
+		}
 		ipStr := ip.String()
-		_, ok := usedIP[ipStr]
+		if _, ok := usedIP[ipStr]; ok {
+			continue
+		}
+		released, ok := s.released[ipStr]
 		if !ok {
 			return ipStr, nil
 		}
+		if now.Sub(released) < s.quarantine {
+			quarantined++
+			continue
+		}
+		if len(found) == 0 || released.Before(foundAt) {
+			found, foundAt = ipStr, released
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no available IP found in CIDR, %v in quarantine", quarantined)
+	}
+	return found, nil
+}
+
+// isHost reports whether ip can be given to a host of ipNet. The network and
+// broadcast addresses of an IPv4 network cannot, except in a /31 or /32,
+// which have none (RFC 3021).
+func isHost(ipNet *net.IPNet, ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return true
+	}
+	if ones, bits := ipNet.Mask.Size(); bits-ones < 2 {
+		return true
+	}
+	network := ipNet.IP.Mask(ipNet.Mask).To4()
+	broadcast := make(net.IP, len(network))
+	for i := range network {
+		broadcast[i] = network[i] | ^ipNet.Mask[len(ipNet.Mask)-len(network)+i]
 	}
-	return "", fmt.Errorf("no available IP found in CIDR")
+	return !ip4.Equal(network) && !ip4.Equal(broadcast)
 }
 
 func incrementIP(ip net.IP) {
@@ -0,0 +1,361 @@
+package ipam
+
+import (
+	"container-network/cluster"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testNode makes the store see a node, as the config would.
+func testNode(t *testing.T) {
+	old := cluster.Instance.Current
+	cluster.Instance.Current = &cluster.Node{IP: "192.168.245.168"}
+	t.Cleanup(func() { cluster.Instance.Current = old })
+}
+
+func testNetwork(cidr string, gateway string) *cluster.Network {
+	return &cluster.Network{Name: cluster.DefaultNetwork, Container: &cluster.Container{CIDR: cidr, Gateway: gateway}}
+}
+
+func TestOpen(t *testing.T) {
+	testNode(t)
+	network := testNetwork("172.18.10.0/24", "172.18.10.1")
+
+	tests := []struct {
+		name string
+		// setup prepares the store file at path.
+		setup   func(t *testing.T, path string)
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "missing file",
+			setup: func(t *testing.T, path string) {},
+			want:  map[string]string{},
+		},
+		{
+			name: "leases of an earlier run",
+			setup: func(t *testing.T, path string) {
+				s, err := Open(path, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"a", "b"} {
+					if _, err := s.Allocate(name, network); err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			want: map[string]string{"a": "172.18.10.2", "b": "172.18.10.3"},
+		},
+		{
+			name: "corrupt file",
+			setup: func(t *testing.T, path string) {
+				if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ipam.json")
+			tt.setup(t, path)
+			s, err := Open(path, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Open() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, lease := range s.List() {
+				got[lease.Container] = lease.IP
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("leases = %v, want %v", got, tt.want)
+			}
+			for name, ip := range tt.want {
+				if got[name] != ip {
+					t.Errorf("lease of %v = %v, want %v", name, got[name], ip)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateKeepsLease(t *testing.T) {
+	testNode(t)
+	network := testNetwork("172.18.10.0/24", "172.18.10.1")
+	s, err := Open(filepath.Join(t.TempDir(), "ipam.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		container string
+		want      string
+	}{
+		{"a", "172.18.10.2"},
+		{"b", "172.18.10.3"},
+		{"a", "172.18.10.2"},
+	}
+	for _, tt := range tests {
+		lease, err := s.Allocate(tt.container, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.IP != tt.want {
+			t.Errorf("Allocate(%v) = %v, want %v", tt.container, lease.IP, tt.want)
+		}
+	}
+}
+
+func TestIsHost(t *testing.T) {
+	tests := []struct {
+		cidr string
+		ip   string
+		want bool
+	}{
+		{"172.18.10.0/24", "172.18.10.0", false},
+		{"172.18.10.0/24", "172.18.10.255", false},
+		{"172.18.10.0/24", "172.18.10.5", true},
+		{"10.0.0.0/23", "10.0.0.255", true},
+		{"10.0.0.0/23", "10.0.1.0", true},
+		{"10.0.0.0/23", "10.0.1.255", false},
+		{"10.0.0.0/30", "10.0.0.0", false},
+		{"10.0.0.0/30", "10.0.0.1", true},
+		{"10.0.0.0/30", "10.0.0.2", true},
+		{"10.0.0.0/30", "10.0.0.3", false},
+		{"10.0.0.0/31", "10.0.0.0", true},
+		{"10.0.0.0/31", "10.0.0.1", true},
+		{"10.0.0.1/32", "10.0.0.1", true},
+		{"fd00::/64", "fd00::", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr+" "+tt.ip, func(t *testing.T) {
+			_, ipNet, err := net.ParseCIDR(tt.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isHost(ipNet, net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isHost(%v, %v) = %v, want %v", tt.cidr, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindAvailableIPPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		used    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "/24 skips the network address", cidr: "172.18.10.0/24", used: []string{"172.18.10.1"}, want: "172.18.10.2"},
+		{name: "/23 crosses the third octet", cidr: "10.0.0.0/23", used: usedRange("10.0.0.", 1, 254), want: "10.0.0.255"},
+		{name: "/30 has two hosts", cidr: "10.0.0.0/30", used: []string{"10.0.0.1"}, want: "10.0.0.2"},
+		{name: "/30 skips the broadcast address", cidr: "10.0.0.0/30", used: []string{"10.0.0.1", "10.0.0.2"}, wantErr: true},
+		{name: "/31 uses both addresses", cidr: "10.0.0.0/31", used: []string{"10.0.0.0"}, want: "10.0.0.1"},
+		{name: "/31 full", cidr: "10.0.0.0/31", used: []string{"10.0.0.0", "10.0.0.1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			used := map[string]struct{}{}
+			for _, ip := range tt.used {
+				used[ip] = struct{}{}
+			}
+			got, err := s.findAvailableIP(tt.cidr, used)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("findAvailableIP() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findAvailableIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// usedRange returns prefix+first up to prefix+last.
+func usedRange(prefix string, first int, last int) []string {
+	ips := []string{}
+	for i := first; i <= last; i++ {
+		ips = append(ips, fmt.Sprintf("%v%v", prefix, i))
+	}
+	return ips
+}
+
+func TestFindAvailableIPQuarantine(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	tests := []struct {
+		name     string
+		released map[string]time.Time
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "never used first",
+			released: map[string]time.Time{"10.0.0.2": ago(time.Hour)},
+			want:     "10.0.0.3",
+		},
+		{
+			name: "released the longest ago",
+			released: map[string]time.Time{
+				"10.0.0.2": ago(2 * time.Hour),
+				"10.0.0.3": ago(4 * time.Hour),
+				"10.0.0.4": ago(3 * time.Hour),
+				"10.0.0.5": ago(time.Hour),
+				"10.0.0.6": ago(time.Hour),
+			},
+			want: "10.0.0.3",
+		},
+		{
+			name: "quarantine skipped",
+			released: map[string]time.Time{
+				"10.0.0.2": ago(time.Minute),
+				"10.0.0.3": ago(2 * time.Minute),
+				"10.0.0.4": ago(time.Hour),
+				"10.0.0.5": ago(time.Minute),
+				"10.0.0.6": ago(time.Minute),
+			},
+			want: "10.0.0.4",
+		},
+		{
+			name: "quarantine expired",
+			released: map[string]time.Time{
+				"10.0.0.2": ago(6 * time.Minute),
+				"10.0.0.3": ago(time.Minute),
+				"10.0.0.4": ago(time.Minute),
+				"10.0.0.5": ago(time.Minute),
+				"10.0.0.6": ago(time.Minute),
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "all in quarantine",
+			released: map[string]time.Time{
+				"10.0.0.2": ago(time.Minute),
+				"10.0.0.3": ago(time.Minute),
+				"10.0.0.4": ago(time.Minute),
+				"10.0.0.5": ago(time.Minute),
+				"10.0.0.6": ago(time.Minute),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Open("", 5*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.released = tt.released
+			got, err := s.findAvailableIP("10.0.0.0/29", map[string]struct{}{"10.0.0.1": {}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("findAvailableIP() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findAvailableIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseQuarantine(t *testing.T) {
+	testNode(t)
+	network := testNetwork("10.0.0.0/30", "10.0.0.1")
+
+	tests := []struct {
+		name       string
+		quarantine time.Duration
+		wantErr    bool
+	}{
+		{name: "released address in quarantine", quarantine: time.Hour, wantErr: true},
+		{name: "released address reused", quarantine: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ipam.json")
+			s, err := Open(path, tt.quarantine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Allocate("a", network); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Release("a"); err != nil {
+				t.Fatal(err)
+			}
+			// The release time survives a restart.
+			if s, err = Open(path, tt.quarantine); err != nil {
+				t.Fatal(err)
+			}
+			lease, err := s.Allocate("b", network)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Allocate() = %v, want an error", lease.IP)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lease.IP != "10.0.0.2" {
+				t.Errorf("Allocate() = %v, want 10.0.0.2", lease.IP)
+			}
+			if _, ok := s.released["10.0.0.2"]; ok {
+				t.Error("allocated address still recorded as released")
+			}
+		})
+	}
+}
+
+func TestAdoptTakesRelease(t *testing.T) {
+	testNode(t)
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	s, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Adopt("a", cluster.DefaultNetwork, "10.0.0.2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Adopt("b", cluster.DefaultNetwork, "10.0.0.2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = Open(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.released["10.0.0.2"]; ok {
+		t.Error("adopted address still recorded as released")
+	}
+}
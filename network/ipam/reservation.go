@@ -0,0 +1,205 @@
+package ipam
+
+import (
+	"container-network/cluster"
+	"fmt"
+	"net"
+	"path"
+)
+
+// Reserve adds the reservation, or replaces the one of the same container
+// on the same network. The addresses must be free or leased to a container
+// the reservation matches.
+func (s *Store) Reserve(r *cluster.Reservation) error {
+	network := cluster.Instance.Current.Network(r.Network)
+	if network == nil {
+		return fmt.Errorf("unknown network: %v", r.Network)
+	}
+	reservation := *r
+	reservation.Network = network.Name
+	if len(reservation.Container) == 0 {
+		return fmt.Errorf("missing container")
+	}
+	if _, err := path.Match(reservation.Container, ""); err != nil {
+		return fmt.Errorf("invalid container pattern: %v", reservation.Container)
+	}
+	if len(reservation.IP) == 0 && len(reservation.IP6) == 0 {
+		return fmt.Errorf("missing ip. container: %v", reservation.Container)
+	}
+	if err := validate(reservation.IP, network.Container.CIDR, network.Container.Gateway); err != nil {
+		return err
+	}
+	if err := validate(reservation.IP6, network.Container.CIDR6, network.Container.Gateway6); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, other := range s.reservationsOf(network) {
+		if other.Container == reservation.Container {
+			continue
+		}
+		if conflicts(other.IP, reservation.IP) || conflicts(other.IP6, reservation.IP6) {
+			return fmt.Errorf("address already reserved. container: %v", other.Container)
+		}
+	}
+	for _, lease := range s.leases {
+		if lease.Network != network.Name || matches(&reservation, lease.Container) {
+			continue
+		}
+		if conflicts(lease.IP, reservation.IP) || conflicts(lease.IP6, reservation.IP6) {
+			return fmt.Errorf("address already leased. container: %v", lease.Container)
+		}
+	}
+
+	old := s.reservations
+	s.reservations = []*cluster.Reservation{}
+	for _, other := range old {
+		if other.Network != reservation.Network || other.Container != reservation.Container {
+			s.reservations = append(s.reservations, other)
+		}
+	}
+	s.reservations = append(s.reservations, &reservation)
+	if err := s.save(); err != nil {
+		s.reservations = old
+		return fmt.Errorf("failed to save reservation. container: %v. error: %v", reservation.Container, err)
+	}
+	return nil
+}
+
+// Unreserve removes the reservation of the container made through the API.
+// The lease it got stays until the container goes away.
+func (s *Store) Unreserve(network string, container string) error {
+	if len(network) == 0 {
+		network = cluster.DefaultNetwork
+	}
+	s.Lock()
+	defer s.Unlock()
+	old := s.reservations
+	s.reservations = []*cluster.Reservation{}
+	for _, r := range old {
+		if r.Network != network || r.Container != container {
+			s.reservations = append(s.reservations, r)
+		}
+	}
+	if len(s.reservations) == len(old) {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		s.reservations = old
+		return fmt.Errorf("failed to remove reservation. container: %v. error: %v", container, err)
+	}
+	return nil
+}
+
+// Reservations returns the reservations of the config followed by the ones
+// made through the API.
+func (s *Store) Reservations() []*cluster.Reservation {
+	s.Lock()
+	defer s.Unlock()
+	reservations := []*cluster.Reservation{}
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		for _, r := range s.reservationsOf(network) {
+			reservation := *r
+			reservations = append(reservations, &reservation)
+		}
+	}
+	return reservations
+}
+
+// reservationsOf returns the reservations of the network, the ones of the
+// config first, all with Network set.
+func (s *Store) reservationsOf(network *cluster.Network) []*cluster.Reservation {
+	reservations := []*cluster.Reservation{}
+	if network.Container != nil {
+		for _, r := range network.Container.Reservations {
+			reservation := *r
+			reservation.Network = network.Name
+			reservations = append(reservations, &reservation)
+		}
+	}
+	for _, r := range s.reservations {
+		if r.Network == network.Name {
+			reservations = append(reservations, r)
+		}
+	}
+	return reservations
+}
+
+// reservation returns the reservation of the container on the network, or
+// nil. A reservation naming the container wins over a pattern.
+func (s *Store) reservation(name string, network *cluster.Network) *cluster.Reservation {
+	var found *cluster.Reservation
+	for _, r := range s.reservationsOf(network) {
+		if r.Container == name {
+			return r
+		}
+		if found == nil && matches(r, name) {
+			found = r
+		}
+	}
+	return found
+}
+
+// reserved checks that the reserved address ip of the container is usable:
+// inside the network and not leased to another container.
+func (s *Store) reserved(name string, ip string, cidr string, gateway string) error {
+	if err := validate(ip, cidr, gateway); err != nil {
+		return fmt.Errorf("invalid reservation. container: %v. error: %v", name, err)
+	}
+	for _, lease := range s.leases {
+		if lease.Container != name && (lease.IP == ip || lease.IP6 == ip) {
+			return fmt.Errorf("reserved ip %v is leased to %v. container: %v", ip, lease.Container, name)
+		}
+	}
+	return nil
+}
+
+// leasedToOther reports whether an address of the reservation is leased to
+// a container other than name.
+func (s *Store) leasedToOther(r *cluster.Reservation, name string) bool {
+	for _, lease := range s.leases {
+		if lease.Container != name && (conflicts(lease.IP, r.IP) || conflicts(lease.IP6, r.IP6)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(r *cluster.Reservation, name string) bool {
+	matched, _ := path.Match(r.Container, name)
+	return matched
+}
+
+func conflicts(ip string, other string) bool {
+	return len(ip) > 0 && ip == other
+}
+
+// validate checks that ip, if set, is a host address of cidr other than
+// the gateway.
+func validate(ip string, cidr string, gateway string) error {
+	if len(ip) == 0 {
+		return nil
+	}
+	if len(cidr) == 0 {
+		return fmt.Errorf("no cidr for ip %v", ip)
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip: %v", ip)
+	}
+	if !ipNet.Contains(parsed) {
+		return fmt.Errorf("ip %v not in %v", ip, cidr)
+	}
+	if !isHost(ipNet, parsed) {
+		return fmt.Errorf("ip %v is not a host address of %v", ip, cidr)
+	}
+	if parsed.Equal(net.ParseIP(gateway)) {
+		return fmt.Errorf("ip %v is the gateway", ip)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"container-network/cluster"
+	"testing"
+)
+
+// testReservations makes the node's default network 172.18.10.0/24 with the
+// reservations of the config.
+func testReservations(t *testing.T, reservations ...*cluster.Reservation) *cluster.Network {
+	old := cluster.Instance.Current
+	cluster.Instance.Current = &cluster.Node{
+		IP:        "192.168.245.168",
+		Container: &cluster.Container{CIDR: "172.18.10.0/24", Gateway: "172.18.10.1", Reservations: reservations},
+	}
+	t.Cleanup(func() { cluster.Instance.Current = old })
+	return cluster.Instance.Current.DefaultNetwork()
+}
+
+func TestAllocateReserved(t *testing.T) {
+	tests := []struct {
+		name         string
+		reservations []*cluster.Reservation
+		// containers are allocated in order, want holds their addresses.
+		containers []string
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:         "exact",
+			reservations: []*cluster.Reservation{{Container: "db", IP: "172.18.10.10"}},
+			containers:   []string{"web", "db"},
+			want:         []string{"172.18.10.2", "172.18.10.10"},
+		},
+		{
+			name:         "pattern",
+			reservations: []*cluster.Reservation{{Container: "cache-*", IP: "172.18.10.11"}},
+			containers:   []string{"cache-1"},
+			want:         []string{"172.18.10.11"},
+		},
+		{
+			name:         "second container matching a pattern",
+			reservations: []*cluster.Reservation{{Container: "cache-*", IP: "172.18.10.11"}},
+			containers:   []string{"cache-1", "cache-2"},
+			want:         []string{"172.18.10.11", "172.18.10.2"},
+		},
+		{
+			name: "exact wins over pattern",
+			reservations: []*cluster.Reservation{
+				{Container: "cache-*", IP: "172.18.10.11"},
+				{Container: "cache-1", IP: "172.18.10.12"},
+			},
+			containers: []string{"cache-1", "cache-2"},
+			want:       []string{"172.18.10.12", "172.18.10.11"},
+		},
+		{
+			name:         "reserved address skipped by others",
+			reservations: []*cluster.Reservation{{Container: "db", IP: "172.18.10.2"}},
+			containers:   []string{"web"},
+			want:         []string{"172.18.10.3"},
+		},
+		{
+			name:         "reservation outside the network",
+			reservations: []*cluster.Reservation{{Container: "db", IP: "172.18.20.10"}},
+			containers:   []string{"db"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := testReservations(t, tt.reservations...)
+			s, err := Open("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, name := range tt.containers {
+				lease, err := s.Allocate(name, network)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatalf("Allocate(%v) = %v, want an error", name, lease.IP)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lease.IP != tt.want[i] {
+					t.Errorf("Allocate(%v) = %v, want %v", name, lease.IP, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      []*cluster.Reservation
+		leases      map[string]string
+		reservation *cluster.Reservation
+		wantErr     bool
+	}{
+		{
+			name:        "free address",
+			reservation: &cluster.Reservation{Container: "db", IP: "172.18.10.10"},
+		},
+		{
+			name:        "gateway",
+			reservation: &cluster.Reservation{Container: "db", IP: "172.18.10.1"},
+			wantErr:     true,
+		},
+		{
+			name:        "broadcast address",
+			reservation: &cluster.Reservation{Container: "db", IP: "172.18.10.255"},
+			wantErr:     true,
+		},
+		{
+			name:        "reserved in the config",
+			config:      []*cluster.Reservation{{Container: "web", IP: "172.18.10.10"}},
+			reservation: &cluster.Reservation{Container: "db", IP: "172.18.10.10"},
+			wantErr:     true,
+		},
+		{
+			name:        "leased to a container the pattern matches",
+			leases:      map[string]string{"db-1": "172.18.10.10"},
+			reservation: &cluster.Reservation{Container: "db-*", IP: "172.18.10.10"},
+		},
+		{
+			name:        "leased to another container",
+			leases:      map[string]string{"web": "172.18.10.10"},
+			reservation: &cluster.Reservation{Container: "db-*", IP: "172.18.10.10"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid pattern",
+			reservation: &cluster.Reservation{Container: "db-[", IP: "172.18.10.10"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testReservations(t, tt.config...)
+			s, err := Open("", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, ip := range tt.leases {
+				if err := s.Adopt(name, cluster.DefaultNetwork, ip, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = s.Reserve(tt.reservation)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Reserve() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
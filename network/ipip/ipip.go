@@ -0,0 +1,95 @@
+package ipip
+
+import (
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
+	"context"
+	"fmt"
+)
+
+func init() {
+	driver.Register("ipip", func() driver.Driver { return New() })
+}
+
+func New() *IPIP {
+	return &IPIP{tunl0: "tunl0", mtu: 1480}
+}
+
+// IPIP routes every peer's container CIDR through the tunl0 fallback device,
+// with the peer's node IP as the onlink next hop.
+type IPIP struct {
+	driver.Peers
+	tunl0 string
+	mtu   int
+	// wasUp and wasMTU are the state of tunl0 before Init, which Cleanup
+	// restores. tunl0 may be used by other software, such as Calico.
+	wasUp  bool
+	wasMTU int
+}
+
+func (i *IPIP) Init() error {
+	if nl.LinkExists(i.tunl0) {
+		up, err := nl.IsLinkUp(i.tunl0)
+		if err != nil {
+			return fmt.Errorf("failed to read tunl0. error: %v", err)
+		}
+		mtu, err := nl.LinkMTU(i.tunl0)
+		if err != nil {
+			return fmt.Errorf("failed to read tunl0 mtu. error: %v", err)
+		}
+		i.wasUp, i.wasMTU = up, mtu
+	}
+
+	// Loading the ipip module creates tunl0 itself, so EEXIST is expected.
+	if err := nl.AddIPIP(i.tunl0); err != nil && !nl.IsExist(err) {
+		return fmt.Errorf("failed to create tunl0. error: %v", err)
+	}
+
+	if err := nl.SetLinkMTU(i.tunl0, i.mtu); err != nil {
+		return fmt.Errorf("failed to set tunl0 mtu. error: %v", err)
+	}
+	return nil
+}
+
+func (i *IPIP) Reconcile(ctx context.Context) error {
+	return nil
+}
+
+// Desired returns tunl0, up, and the route to the CIDR of every peer through
+// it. tunl0 only carries IPv4, so an IPv6-only peer gets no route.
+func (i *IPIP) Desired() []reconcile.Object {
+	objs := []reconcile.Object{&reconcile.Link{Name: i.tunl0}}
+	for _, node := range i.Nodes() {
+		if len(node.Container.CIDR) == 0 {
+			continue
+		}
+		objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: node.Container.CIDR, Via: node.IP, Dev: i.tunl0, Onlink: true}})
+	}
+	return objs
+}
+
+// Scope is empty, tunl0 is not the daemon's.
+func (i *IPIP) Scope() reconcile.Scope {
+	return reconcile.Scope{}
+}
+
+// Cleanup gives tunl0 back the MTU and up or down state it had before Init.
+// Mgr has already removed the routes of Desired, and tunl0 belongs to the
+// ipip module, it cannot be deleted.
+func (i *IPIP) Cleanup() error {
+	if !nl.LinkExists(i.tunl0) {
+		return nil
+	}
+	if i.wasMTU > 0 && i.wasMTU != i.mtu {
+		if err := nl.SetLinkMTU(i.tunl0, i.wasMTU); err != nil {
+			return fmt.Errorf("failed to restore tunl0 mtu. error: %v", err)
+		}
+	}
+	if !i.wasUp {
+		if err := nl.SetLinkDown(i.tunl0); err != nil && !nl.IsNotExist(err) {
+			return fmt.Errorf("failed to set tunl0 down. error: %v", err)
+		}
+	}
+	return nil
+}
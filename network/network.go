@@ -1,41 +1,328 @@
 package network
 
 import (
+	"container-network/cluster"
+	"container-network/containerd"
 	"container-network/fn"
+	_ "container-network/network/bgp"
 	"container-network/network/bridge"
-	"container-network/network/overlay"
+	"container-network/network/driver"
+	_ "container-network/network/geneve"
+	"container-network/network/ipam"
+	_ "container-network/network/ipip"
+	_ "container-network/network/overlay"
+	"container-network/network/reconcile"
+	_ "container-network/network/route"
+	_ "container-network/network/wireguard"
 	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 func New() *Mgr {
-	return &Mgr{
-		network: fn.Args("network"),
+	owner, err := reconcile.NewOwner(statePath("owned.json"))
+	if err != nil {
+		panic(err)
+	}
+	// --ip-quarantine=<duration> is how long a released address stays
+	// unused, so peers drop their state for the old container first.
+	quarantine := 5 * time.Minute
+	if arg := fn.Args("ip-quarantine"); len(arg) > 0 {
+		if quarantine, err = time.ParseDuration(arg); err != nil {
+			panic(err)
+		}
+	}
+	if ipam.Instance, err = ipam.Open(statePath("ipam.json"), quarantine); err != nil {
+		panic(err)
+	}
+	if ipam.Blocks, err = ipam.OpenBlocks(statePath("blocks.json")); err != nil {
+		panic(err)
 	}
+	m := &Mgr{
+		network:    fn.Args("network"),
+		nodes:      map[string]*cluster.Node{},
+		reconciler: reconcile.New(owner),
+		collects:   make(chan chan []string),
+	}
+	m.handleCNI()
+	m.handleReservations()
+	m.handleBlocks()
+	cluster.Instance.Handle("GET", "/status", m.status)
+	// Collections delete datapath objects, so only the node may ask for one.
+	cluster.Instance.HandleLocal("POST", "/gc", m.gc)
+	return m
+}
+
+// statePath returns the path of a state file under fn.StateDir. A dry run
+// changes nothing, so it keeps its state in memory and gets "".
+func statePath(name string) string {
+	if fn.Flag("dry-run") {
+		return ""
+	}
+	return filepath.Join(fn.StateDir, name)
 }
 
 type Mgr struct {
 	network string
 	bridge  *bridge.Bridge
-	overlay *overlay.Overlay
+	driver  driver.Driver
+	// nodes holds the peers handed to the driver, keyed by nodeKey.
+	nodes      map[string]*cluster.Node
+	reconciler *reconcile.Reconciler
+	// collects carries the on demand collections to the loop of Running.
+	collects chan chan []string
+	sync.Mutex
 }
 
+// Running drives the bridge and the driver from one loop. Containers are
+// wired up as soon as containerd reports them. A container that fails, e.g.
+// because its netns is not mounted yet, is retried every second a few times,
+// and every container is revisited on a slow resync. Every 5 seconds the
+// driver learns about the peers and the reconciler brings the host in line
+// with the desired state of both. Every 10 minutes, and on demand, the
+// orphans are collected.
 func (m *Mgr) Running(ctx context.Context) {
-	m.bridge = bridge.New()
-	go m.bridge.Running(ctx)
+	select {
+	case <-ctx.Done():
+		return
+	case <-cluster.Instance.Loaded():
+	}
+	cluster.Instance.Join(ctx)
+	if err := m.claim(ctx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		panic(err)
+	}
+
+	b := bridge.New(m.reconciler)
+	m.Lock()
+	m.bridge = b
+	m.Unlock()
+
+	if len(m.network) > 0 {
+		d, err := driver.New(m.network)
+		if err != nil {
+			panic(err)
+		}
+		if err := d.Init(); err != nil {
+			panic(err)
+		}
+		m.driver = d
+	}
+
+	events := containerd.Instance.Subscribe()
+	// pending holds the containers to wire up and their remaining attempts.
+	pending := map[string]int{}
+	resync := func() {
+		for name := range containerd.Instance.List() {
+			pending[name] = 5
+		}
+	}
+	resync()
+	m.reconcile(ctx)
+	resyncTicker := time.NewTicker(time.Second * 30)
+	defer resyncTicker.Stop()
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	gcTicker := time.NewTicker(time.Minute * 10)
+	defer gcTicker.Stop()
+
+	for {
+		for name := range pending {
+			if err := b.Sync(name); err != nil {
+				fn.Errorf("%v", err)
+				if pending[name]--; pending[name] > 0 {
+					continue
+				}
+			}
+			delete(pending, name)
+		}
+
+		var retry <-chan time.Time
+		if len(pending) > 0 {
+			retry = time.After(time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			switch event.Type {
+			case containerd.Added:
+				pending[event.Name] = 5
+			case containerd.Removed:
+				// The pass withdraws the objects of the container.
+				delete(pending, event.Name)
+				if err := ipam.Instance.Release(event.Name); err != nil {
+					fn.Errorf("%v", err)
+				}
+				m.apply()
+			}
+		case <-retry:
+		case <-resyncTicker.C:
+			resync()
+		case <-ticker.C:
+			m.reconcile(ctx)
+		case <-gcTicker.C:
+			m.collect()
+		case collected := <-m.collects:
+			collected <- m.collect()
+		}
+	}
+}
+
+// reconcile joins the peers that have not accepted the node yet, hands the
+// cluster nodes to the driver, lets it refresh and then brings the host in
+// line with the desired state.
+func (m *Mgr) reconcile(ctx context.Context) {
+	cluster.Instance.Join(ctx)
+	if m.driver != nil {
+		m.reconcileNodes(ctx)
+	}
+	m.apply()
+}
+
+func (m *Mgr) apply() {
+	m.reconciler.Reconcile(m.desired)
+}
+
+func (m *Mgr) desired() []reconcile.Object {
+	objs := m.bridge.Desired()
+	if d, ok := m.driver.(driver.Stateful); ok {
+		objs = append(objs, d.Desired()...)
+	}
+	return objs
+}
+
+// collect deletes the orphans of the bridge and the driver, and releases the
+// leases of containers that went away while the daemon was down. The bridge
+// lock keeps containers from being linked while their links look orphaned.
+func (m *Mgr) collect() []string {
+	m.bridge.Lock()
+	defer m.bridge.Unlock()
+	scope := m.bridge.Scope()
+	if d, ok := m.driver.(driver.Stateful); ok {
+		scope.Devices = append(scope.Devices, d.Scope().Devices...)
+		scope.LinkPrefixes = append(scope.LinkPrefixes, d.Scope().LinkPrefixes...)
+	}
+	collected := m.reconciler.Collect(m.desired, scope)
 
-	switch m.network {
-	case "overlay":
-		m.overlay = overlay.New()
-		m.overlay.Running(ctx)
-	case "route":
-	default:
-		// return fmt.Errorf("unknown network type: %v", m.network)
+	containers := containerd.Instance.List()
+	for _, lease := range ipam.Instance.List() {
+		if _, ok := containers[lease.Container]; ok {
+			continue
+		}
+		if err := ipam.Instance.Release(lease.Container); err != nil {
+			fn.Errorf("%v", err)
+			continue
+		}
+		fn.Infof("collected lease %v", lease.Container)
+		collected = append(collected, "lease "+lease.Container)
 	}
+	return collected
 }
 
-// func (m *Mgr) Cleanup() error {
-// 	if err := m.bridge.Cleanup(); err != nil {
-// 		return err
-// 	}
-// 	return m.overlay.Cleanup()
-// }
+// nodeKey identifies a peer with its container CIDRs, so a peer whose block
+// changes is removed from the driver and added again.
+func nodeKey(node *cluster.Node) string {
+	return node.IP + " " + node.Container.CIDR + " " + node.Container.CIDR6
+}
+
+// reconcileNodes hands the peers with an IPv4 or IPv6 container CIDR to the
+// driver. The
+// departed peers are removed first, since the driver tracks peers by IP.
+func (m *Mgr) reconcileNodes(ctx context.Context) {
+	m.assignPeers(ctx)
+	desired := map[string]*cluster.Node{}
+	for _, node := range cluster.Instance.Peers() {
+		if node.Container == nil || (len(node.Container.CIDR) == 0 && len(node.Container.CIDR6) == 0) {
+			continue
+		}
+		desired[nodeKey(node)] = node
+	}
+
+	for key, node := range m.nodes {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := m.driver.RemoveNode(node); err != nil {
+			fn.Errorf("failed to remove node. driver: %v. node: %v. error: %v", m.network, node, err)
+			continue
+		}
+		delete(m.nodes, key)
+	}
+
+	for key, node := range desired {
+		if _, ok := m.nodes[key]; ok {
+			continue
+		}
+		if err := m.driver.AddNode(node); err != nil {
+			fn.Errorf("failed to add node. driver: %v. node: %v. error: %v", m.network, node, err)
+			continue
+		}
+		m.nodes[key] = node
+	}
+
+	if err := m.driver.Reconcile(ctx); err != nil {
+		fn.Errorf("failed to reconcile. driver: %v. error: %v", m.network, err)
+	}
+}
+
+// status reports the outcome of the last reconciler pass over every object.
+func (m *Mgr) status(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bys, err := json.Marshal(m.reconciler.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// gc collects the orphans now and returns their keys.
+func (m *Mgr) gc(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	collected := make(chan []string, 1)
+	select {
+	case m.collects <- collected:
+	case <-r.Context().Done():
+		return
+	}
+	bys, err := json.Marshal(<-collected)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// Cleanup removes everything the daemon created, in the reverse order of
+// Running: the driver's routes and devices first, then the bridge. It must
+// only be called once Running has returned.
+func (m *Mgr) Cleanup() error {
+	var first error
+	if m.driver != nil {
+		fn.Infof("cleaning up driver. driver: %v", m.network)
+		if d, ok := m.driver.(driver.Stateful); ok {
+			first = m.reconciler.Remove(d.Desired())
+		}
+		if err := m.driver.Cleanup(); err != nil {
+			fn.Errorf("failed to clean up driver. driver: %v. error: %v", m.network, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if b := m.getBridge(); b != nil {
+		fn.Infof("cleaning up bridge")
+		if err := b.Cleanup(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
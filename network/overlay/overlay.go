@@ -2,101 +2,222 @@ package overlay
 
 import (
 	"container-network/cluster"
+	"container-network/containerd"
 	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
 	"context"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"time"
 )
 
+func init() {
+	driver.Register("overlay", func() driver.Driver { return New() })
+}
+
 func New() *Overlay {
-	o := &Overlay{vxlan100: "vxlan100", dstport: "4789"}
-	if err := o.init(); err != nil {
-		panic(err)
+	return &Overlay{
+		dstport:    4789,
+		macs:       map[string]string{},
+		containers: map[string][]*containerd.Container{},
 	}
-	return o
 }
 
+// Overlay connects every cluster network through its own vxlan device,
+// vxlan<VNI>, e.g. vxlan100 for the default network.
 type Overlay struct {
-	vxlan100 string
-	dstport  string
+	driver.Peers
+	dstport int
+	// macs holds the vxlan MAC learned from each peer, keyed by node IP and network name.
+	macs map[string]string
+	// containers holds the containers last fetched from each peer, keyed by node IP.
+	containers map[string][]*containerd.Container
+}
+
+func vxlanName(network *cluster.Network) string {
+	return fmt.Sprintf("vxlan%v", network.VNI)
+}
+
+func macKey(node *cluster.Node, network *cluster.Network) string {
+	return node.IP + "/" + network.Name
+}
+
+func (o *Overlay) Init() error {
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		if err := o.initNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (o *Overlay) init() error {
-	cmd := exec.Command("ip", "link", "add", o.vxlan100, "type", "vxlan", "id", "100", "local", cluster.Instance.Current.IP, "dev", cluster.Instance.Current.Interface, "dstport", o.dstport, "nolearning")
-	cmdout, err := cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-		return fmt.Errorf("failed to create vxlan100. cmdout: %s. error: %v", cmdout, err)
+func (o *Overlay) initNetwork(network *cluster.Network) error {
+	if network.VXLAN == nil {
+		return fmt.Errorf("vxlan is not configured. network: %v", network.Name)
 	}
+	vxlan := vxlanName(network)
 
-	cmd = exec.Command("ip", "addr", "add", cluster.Instance.Current.VXLAN.IP, "dev", o.vxlan100)
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-		return fmt.Errorf("failed to add IP to vxlan100. IP: %v. cmdout: %s. error: %v", cluster.Instance.Current.VXLAN.IP, cmdout, err)
+	// The device is tagged, so Cleanup and the collector treat it as owned.
+	err := nl.AddVXLAN(vxlan, network.VNI, cluster.Instance.Current.IP, cluster.Instance.Current.Interface, o.dstport)
+	if err == nil {
+		if err := reconcile.TagLink(vxlan); err != nil {
+			return fmt.Errorf("failed to tag %v. error: %v", vxlan, err)
+		}
+	} else if !nl.IsExist(err) {
+		return fmt.Errorf("failed to create %v. error: %v", vxlan, err)
 	}
 
-	cmd = exec.Command("ip", "link", "set", o.vxlan100, "up")
-	cmdout, err = cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to set vxlan100 up. cmdout: %s. error: %v", cmdout, err)
+	if err := nl.AddAddr(vxlan, network.VXLAN.IP, false); err != nil && !nl.IsExist(err) {
+		return fmt.Errorf("failed to add IP to %v. IP: %v. error: %v", vxlan, network.VXLAN.IP, err)
 	}
 
-	cmd = exec.Command("ip", "link", "show", o.vxlan100)
-	cmdout, err = cmd.CombinedOutput()
+	if err := nl.SetLinkUp(vxlan); err != nil {
+		return fmt.Errorf("failed to set %v up. error: %v", vxlan, err)
+	}
+
+	mac, err := nl.LinkMAC(vxlan)
 	if err != nil {
-		return fmt.Errorf("failed to show vxlan100. cmdout: %s. error: %v", cmdout, err)
+		return fmt.Errorf("no MAC address found for %v. error: %v", vxlan, err)
+	}
+	network.VXLAN.MAC = mac
+	return nil
+}
+
+// peerNetworks returns the networks of the node that also exist locally.
+func peerNetworks(node *cluster.Node) []*cluster.Network {
+	networks := []*cluster.Network{}
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		peer := node.Network(network.Name)
+		if peer == nil || peer.Container == nil {
+			continue
+		}
+		// The peer's CIDRs are routed through the local vxlan device of the network.
+		p := *peer
+		p.VNI = network.VNI
+		networks = append(networks, &p)
+	}
+	return networks
+}
+
+// RemoveNode also forgets the vxlan MACs and containers of the peer.
+func (o *Overlay) RemoveNode(node *cluster.Node) error {
+	for _, network := range peerNetworks(node) {
+		delete(o.macs, macKey(node, network))
+	}
+	delete(o.containers, node.IP)
+	return o.Peers.RemoveNode(node)
+}
+
+// Reconcile refreshes what the overlay knows about the peers. A peer that
+// cannot be reached keeps its last known containers and MACs.
+func (o *Overlay) Reconcile(ctx context.Context) error {
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		// The vxlan device gets a new MAC when it is recreated.
+		if mac, err := nl.LinkMAC(vxlanName(network)); err == nil {
+			network.VXLAN.MAC = mac
+		}
 	}
-	re := regexp.MustCompile(`link/ether\s([0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5})`)
-	matches := re.FindStringSubmatch(string(cmdout))
-	if len(matches) < 2 {
-		return fmt.Errorf("no MAC address found for vxlan100. cmdout: %s", cmdout)
+	for _, node := range o.Nodes() {
+		containers, err := cluster.Instance.GetContainers(ctx, node.IP)
+		if err != nil {
+			fn.Errorf("failed to get containers. node: %v. error: %v", node, err)
+		} else {
+			o.containers[node.IP] = containers
+		}
+		for _, network := range peerNetworks(node) {
+			mac, err := cluster.Instance.GetVXLANMAC(ctx, node.IP, network.Name)
+			if err != nil {
+				fn.Errorf("failed to get vxlan mac. node: %v. network: %v. error: %v", node, network.Name, err)
+				continue
+			}
+			o.macs[macKey(node, network)] = mac
+		}
 	}
-	cluster.Instance.Current.VXLAN.MAC = matches[1]
 	return nil
 }
 
-func (o *Overlay) Running(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Second * 5):
-			for _, node := range cluster.Instance.Nodes {
-				cmd := exec.Command("ip", "route", "add", node.Container.CIDR, "dev", o.vxlan100)
-				cmdout, err := cmd.CombinedOutput()
-				if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-					fn.Errorf("failed to add CIDR to vxlan100. node: %v. cmdout: %s. error: %v", node, cmdout, err)
-				}
-				containers, err := cluster.Instance.GetContainers(ctx, node.IP)
-				if err != nil {
-					fn.Errorf("failed to get containers. node: %v. error: %v", node, err)
-					continue
-				}
-				mac, err := cluster.Instance.GetVXLANMAC(ctx, node.IP)
-				if err != nil {
-					fn.Errorf("failed to get vxlan mac. node: %v. error: %v", node, err)
-					continue
-				}
-				for _, container := range containers {
-					if len(container.IP) == 0 {
-						continue
-					}
-					cmd = exec.Command("ip", "neighbor", "add", container.IP, "lladdr", mac, "dev", o.vxlan100)
-					cmdout, err = cmd.CombinedOutput()
-					if err != nil && !fn.MatchCMDOut(cmdout, "File exists") {
-						fn.Errorf("failed to add container to vxlan100. node: %+v. VXLAN: %+v. container: %+v. cmdout: %s. error: %v", node, node.VXLAN, container, cmdout, err)
-					}
-
-					cmd = exec.Command("bridge", "fdb", "append", mac, "dev", o.vxlan100, "dst", node.IP)
-					cmdout, err = cmd.CombinedOutput()
-					if err != nil {
-						fn.Errorf("failed to add container to vxlan100. node: %+v. VXLAN: %+v. container: %+v. cmdout: %s. error: %v", node, node.VXLAN, container, cmdout, err)
-					}
-				}
+// Desired returns the vxlan device of every network and, for every peer, the
+// routes to its CIDRs and the neighbor and FDB entries of its containers.
+func (o *Overlay) Desired() []reconcile.Object {
+	current := cluster.Instance.Current
+	objs := []reconcile.Object{}
+	for _, network := range current.AllNetworks() {
+		vxlan := vxlanName(network)
+		objs = append(objs,
+			&reconcile.Link{Name: vxlan, Add: func() error {
+				return nl.AddVXLAN(vxlan, network.VNI, current.IP, current.Interface, o.dstport)
+			}},
+			&reconcile.Addr{Dev: vxlan, Addr: network.VXLAN.IP},
+		)
+	}
+	for _, node := range o.Nodes() {
+		for _, network := range peerNetworks(node) {
+			objs = append(objs, o.peerObjects(node, network)...)
+		}
+	}
+	return objs
+}
+
+// Scope has the collector look for the routes, neighbor and FDB entries of
+// departed peers and containers on the vxlan devices.
+func (o *Overlay) Scope() reconcile.Scope {
+	scope := reconcile.Scope{}
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		scope.Devices = append(scope.Devices, vxlanName(network))
+	}
+	return scope
+}
+
+// peerObjects returns the routes to the CIDRs of the peer network and, once
+// its MAC is known, the entries of its containers. The peer's FDB entry is
+// only wanted while it has containers.
+func (o *Overlay) peerObjects(node *cluster.Node, network *cluster.Network) []reconcile.Object {
+	vxlan := vxlanName(network)
+	objs := []reconcile.Object{}
+	for _, cidr := range []string{network.Container.CIDR, network.Container.CIDR6} {
+		if len(cidr) > 0 {
+			objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: cidr, Dev: vxlan}})
+		}
+	}
+	mac, ok := o.macs[macKey(node, network)]
+	if !ok {
+		return objs
+	}
+	neighbors := false
+	for _, container := range o.containers[node.IP] {
+		if container.Network != network.Name {
+			continue
+		}
+		for _, ip := range []string{container.IP, container.IP6} {
+			if len(ip) > 0 {
+				objs = append(objs, &reconcile.Neigh{IP: ip, MAC: mac, Dev: vxlan})
+				neighbors = true
 			}
 		}
 	}
+	if neighbors {
+		objs = append(objs, &reconcile.FDB{MAC: mac, Dev: vxlan, Dst: node.IP})
+	}
+	return objs
+}
+
+// Cleanup deletes the vxlan devices the daemon created. Mgr has already
+// removed the objects of Desired, so this only catches devices left over.
+func (o *Overlay) Cleanup() error {
+	for _, network := range cluster.Instance.Current.AllNetworks() {
+		vxlan := vxlanName(network)
+		owned, err := reconcile.OwnsLink(vxlan)
+		if err != nil {
+			return fmt.Errorf("failed to read %v. error: %v", vxlan, err)
+		}
+		if !owned {
+			continue
+		}
+		if err := nl.DelLink(vxlan); err != nil && !nl.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %v. error: %v", vxlan, err)
+		}
+	}
+	return nil
 }
 
 // func (o *Overlay) Update(ctx context.Context, cluster *store.Cluster) {
@@ -128,16 +249,6 @@ func (o *Overlay) Running(ctx context.Context) {
 // 	}
 // }
 
-// func (o *Overlay) Cleanup() error {
-// 	cmd := exec.Command("ip", "link", "del", o.vxlan100)
-// 	cmdout, err := cmd.CombinedOutput()
-// 	if cmdout, err := fn.CheckCMDOut(cmdout, err); err != nil {
-// 		return fmt.Errorf("failed to delete vxlan100. cmdout: %s. error: %v", cmdout, err)
-// 	}
-
-// 	return nil
-// }
-
 // f6:35:84:38:60:f1
 // ip neighbor add 172.18.20.2 lladdr 16:8f:3f:90:b9:2e dev vxlan100
 // bridge fdb append 16:8f:3f:90:b9:2e dev vxlan100 dst 192.168.245.172
@@ -0,0 +1,269 @@
+package network
+
+import (
+	"container-network/cluster"
+	"container-network/fn"
+	"container-network/network/ipam"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func (m *Mgr) handleBlocks() {
+	cluster.Instance.Handle("GET", "/ipam/blocks", m.listBlocks)
+	cluster.Instance.Handle("POST", "/ipam/blocks", m.claimBlock)
+	cluster.Instance.Handle("POST", "/ipam/blocks/commit", m.commitBlock)
+}
+
+func (m *Mgr) listBlocks(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bys, err := json.Marshal(ipam.Blocks.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// claimBlock accepts the proposal of a peer unless the block overlaps the
+// block of another node, the ones in the config included, or a block another
+// node proposed. The block is only recorded once commitBlock gets it.
+func (m *Mgr) claimBlock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	block := m.peerBlock(w, r)
+	if block == nil {
+		return
+	}
+	if err := ipam.Blocks.Propose(block); errors.Is(err, ipam.ErrClaimed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// commitBlock records the block a quorum accepted.
+func (m *Mgr) commitBlock(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	block := m.peerBlock(w, r)
+	if block == nil {
+		return
+	}
+	if err := ipam.Blocks.Claim(block); errors.Is(err, ipam.ErrClaimed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fn.Infof("node %v claimed block %v", block.Node, block.CIDR)
+	w.WriteHeader(http.StatusOK)
+}
+
+// peerBlock decodes the block of a proposal or a commit, or writes the error
+// and returns nil. Peers have to reach both, so they are served on the
+// cluster address, but only a node of the config or a member may claim, only
+// for itself, and never a block that overlaps a container CIDR of the config.
+func (m *Mgr) peerBlock(w http.ResponseWriter, r *http.Request) *cluster.Block {
+	peer := cluster.Instance.Peer(r)
+	if peer == nil {
+		http.Error(w, "not a node of the cluster", http.StatusForbidden)
+		return nil
+	}
+	block := &cluster.Block{}
+	if err := json.NewDecoder(r.Body).Decode(block); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if block.Node != peer.IP {
+		http.Error(w, "a node may only claim a block for itself", http.StatusForbidden)
+		return nil
+	}
+	for _, cidr := range configuredCIDRs() {
+		if ipam.Overlap(cidr, block.CIDR) {
+			http.Error(w, "block overlaps "+cidr, http.StatusConflict)
+			return nil
+		}
+	}
+	return block
+}
+
+// claim gives the node a block of the cluster pool unless its container CIDR
+// is configured. The block of an earlier run, or one a peer remembers, is
+// kept. Otherwise the node proposes the first free block to every peer and
+// takes it once none refuses and a quorum, a majority of the nodes with the
+// node itself, accepts it. The node then commits the block to the peers; one
+// that cannot be reached learns it later. claim blocks until the node has a
+// block.
+func (m *Mgr) claim(ctx context.Context) error {
+	current := cluster.Instance.Current
+	pool := cluster.Instance.Pool
+	if pool == nil || (current.Container != nil && len(current.Container.CIDR) > 0) {
+		return nil
+	}
+	for {
+		cluster.Instance.Join(ctx)
+		m.learnBlocks(ctx)
+		if block := ipam.Blocks.Of(current.IP); block != nil {
+			fn.Infof("using block %v", block.CIDR)
+			return ipam.Assign(current, block)
+		}
+
+		cidr, err := ipam.Blocks.Next(pool, configuredCIDRs())
+		if err != nil {
+			return err
+		}
+		block := &cluster.Block{CIDR: cidr, Node: current.IP, Claimed: time.Now()}
+		// A dry run changes nothing, on the peers neither, so it plans with
+		// the block without proposing it.
+		if fn.Flag("dry-run") {
+			fn.Infof("dry run, using block %v without claiming it", cidr)
+			return ipam.Assign(current, block)
+		}
+		if m.propose(ctx, block) {
+			err := ipam.Blocks.Claim(block)
+			if err == nil {
+				fn.Infof("claimed block %v", cidr)
+				m.commit(ctx, block)
+				return ipam.Assign(current, block)
+			}
+			fn.Errorf("%v", err)
+		}
+
+		// Two nodes claiming the same block refuse each other, the jitter
+		// lets one of them go first on the next round.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))):
+		}
+	}
+}
+
+// propose offers the block to the node itself and to every peer, and reports
+// whether none refused it and a quorum accepted it. A refused proposal is
+// withdrawn locally, so a node proposing the same block can win the next
+// round.
+func (m *Mgr) propose(ctx context.Context, block *cluster.Block) bool {
+	if err := ipam.Blocks.Propose(block); err != nil {
+		fn.Errorf("%v", err)
+		return false
+	}
+	accepted := 1
+	peers := cluster.Instance.Peers()
+	for _, node := range peers {
+		ok, err := cluster.Instance.ClaimBlock(ctx, node.IP, block)
+		if err != nil {
+			fn.Errorf("failed to claim block. node: %v. error: %v", node.IP, err)
+			continue
+		}
+		if !ok {
+			fn.Errorf("block %v refused by node %v", block.CIDR, node.IP)
+			ipam.Blocks.Withdraw(block.Node)
+			return false
+		}
+		accepted++
+	}
+	if quorum := (len(peers)+1)/2 + 1; accepted < quorum {
+		fn.Errorf("block %v accepted by %v nodes, %v needed", block.CIDR, accepted, quorum)
+		ipam.Blocks.Withdraw(block.Node)
+		return false
+	}
+	return true
+}
+
+// commit has the peers record the block. A peer that misses it drops the
+// proposal after ipam.ProposalTTL and learns the block later.
+func (m *Mgr) commit(ctx context.Context, block *cluster.Block) {
+	for _, node := range cluster.Instance.Peers() {
+		ok, err := cluster.Instance.CommitBlock(ctx, node.IP, block)
+		if err != nil {
+			fn.Errorf("failed to commit block. node: %v. error: %v", node.IP, err)
+		} else if !ok {
+			fn.Errorf("block %v refused by node %v on commit", block.CIDR, node.IP)
+		}
+	}
+}
+
+// learnBlocks records the blocks the peers know of.
+func (m *Mgr) learnBlocks(ctx context.Context) {
+	for _, node := range cluster.Instance.Peers() {
+		blocks, err := cluster.Instance.GetBlocks(ctx, node.IP)
+		if err != nil {
+			fn.Errorf("failed to learn blocks. node: %v. error: %v", node.IP, err)
+			continue
+		}
+		for _, block := range blocks {
+			if block.Node == cluster.Instance.Current.IP && ipam.Blocks.Of(block.Node) != nil {
+				continue
+			}
+			if err := ipam.Blocks.Claim(block); err != nil {
+				fn.Errorf("failed to learn block. node: %v. error: %v", block.Node, err)
+			}
+		}
+	}
+}
+
+// assignPeers configures the peers without a container CIDR in the config
+// with their block, asking them for it if it is not known yet. A peer
+// without a block yet is left out of the driver until it has one.
+func (m *Mgr) assignPeers(ctx context.Context) {
+	if cluster.Instance.Pool == nil {
+		return
+	}
+	for _, node := range cluster.Instance.Peers() {
+		block := ipam.Blocks.Of(node.IP)
+		if block == nil && node.Container != nil && len(node.Container.CIDR) > 0 {
+			continue
+		}
+		if block != nil && node.Container != nil && block.CIDR == node.Container.CIDR {
+			continue
+		}
+		if block == nil {
+			blocks, err := cluster.Instance.GetBlocks(ctx, node.IP)
+			if err != nil {
+				fn.Errorf("failed to get block. node: %v. error: %v", node.IP, err)
+				continue
+			}
+			for _, b := range blocks {
+				if b.Node != node.IP {
+					continue
+				}
+				if err := ipam.Blocks.Claim(b); err != nil {
+					fn.Errorf("failed to learn block. node: %v. error: %v", node.IP, err)
+					continue
+				}
+				block = b
+			}
+		}
+		if block == nil {
+			continue
+		}
+		if err := ipam.Assign(node, block); err != nil {
+			fn.Errorf("failed to assign block. node: %v. error: %v", node.IP, err)
+		}
+	}
+}
+
+// configuredCIDRs returns the container CIDRs of the config, which no block
+// may overlap. The CIDRs of assigned blocks are left out.
+func configuredCIDRs() []string {
+	cidrs := []string{}
+	for _, node := range append([]*cluster.Node{cluster.Instance.Current}, cluster.Instance.Peers()...) {
+		for _, network := range node.AllNetworks() {
+			if network.Container == nil || len(network.Container.CIDR) == 0 {
+				continue
+			}
+			if network.Name == cluster.DefaultNetwork && ipam.Blocks.Of(node.IP) != nil {
+				continue
+			}
+			cidrs = append(cidrs, network.Container.CIDR)
+		}
+	}
+	return cidrs
+}
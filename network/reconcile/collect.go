@@ -0,0 +1,128 @@
+package reconcile
+
+import (
+	"container-network/fn"
+	"container-network/fn/nl"
+	"sort"
+	"strings"
+)
+
+// Scope tells the collector where to look for orphans in the kernel, besides
+// the objects the owner recorded.
+type Scope struct {
+	// Devices are owned devices whose permanent neighbor and FDB entries and
+	// added routes all come from the daemon, e.g. vxlan100.
+	Devices []string
+	// LinkPrefixes name the owned links that only exist for a desired Link,
+	// e.g. veth1 for the host side veths.
+	LinkPrefixes []string
+}
+
+// Collect deletes the orphans: owned objects that are neither desired nor
+// installed, e.g. because they were left behind while the daemon was down,
+// and the objects in scope that are not desired. It returns the keys of the
+// objects it deleted.
+func (r *Reconciler) Collect(desired func() []Object, scope Scope) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	keep := map[string]struct{}{}
+	for _, obj := range desired() {
+		keep[obj.Key()] = struct{}{}
+	}
+	for key := range r.installed {
+		keep[key] = struct{}{}
+	}
+
+	orphans := []Object{}
+	for _, record := range r.owner.Records() {
+		if _, ok := keep[record.Key]; ok {
+			continue
+		}
+		obj, err := record.Decode()
+		if err != nil {
+			fn.Errorf("failed to decode %v. error: %v", record.Key, err)
+			continue
+		}
+		orphans = append(orphans, obj)
+	}
+	orphans = append(orphans, r.scan(scope)...)
+
+	// Entries go before the links they are on.
+	sort.SliceStable(orphans, func(i, j int) bool { return !isLink(orphans[i]) && isLink(orphans[j]) })
+
+	collected := []string{}
+	seen := map[string]struct{}{}
+	for _, obj := range orphans {
+		if _, ok := keep[obj.Key()]; ok {
+			continue
+		}
+		if _, ok := seen[obj.Key()]; ok {
+			continue
+		}
+		seen[obj.Key()] = struct{}{}
+		if err := obj.Delete(); err != nil {
+			r.fail(obj.Key(), "collect", err)
+			continue
+		}
+		if err := r.owner.Remove(obj.Key()); err != nil {
+			fn.Errorf("failed to forget %v. error: %v", obj.Key(), err)
+		}
+		fn.Infof("collected %v", obj.Key())
+		r.set(obj.Key(), Deleted, nil)
+		collected = append(collected, obj.Key())
+	}
+	return collected
+}
+
+func isLink(obj Object) bool {
+	_, ok := obj.(*Link)
+	return ok
+}
+
+// scan lists the objects in scope.
+func (r *Reconciler) scan(scope Scope) []Object {
+	objs := []Object{}
+	if len(scope.LinkPrefixes) > 0 {
+		names, err := nl.LinksByAlias(Alias)
+		if err != nil {
+			fn.Errorf("failed to list links. error: %v", err)
+		}
+		for _, name := range names {
+			for _, prefix := range scope.LinkPrefixes {
+				if strings.HasPrefix(name, prefix) {
+					objs = append(objs, &Link{Name: name})
+					break
+				}
+			}
+		}
+	}
+
+	for _, dev := range scope.Devices {
+		if owned, err := OwnsLink(dev); err != nil || !owned {
+			continue
+		}
+		routes, err := nl.Routes(dev)
+		if err != nil {
+			fn.Errorf("failed to list routes. device: %v. error: %v", dev, err)
+		}
+		for _, route := range routes {
+			objs = append(objs, &Route{Route: route})
+		}
+		fdbs, err := nl.FDBs(dev)
+		if err != nil {
+			fn.Errorf("failed to list fdb entries. device: %v. error: %v", dev, err)
+		}
+		for _, entry := range fdbs {
+			objs = append(objs, &FDB{MAC: entry.MAC, Dev: dev, Dst: entry.Dst})
+		}
+		neighs, err := nl.Neighs(dev)
+		if err != nil {
+			fn.Errorf("failed to list neighbors. device: %v. error: %v", dev, err)
+		}
+		for _, entry := range neighs {
+			objs = append(objs, &Neigh{IP: entry.IP, MAC: entry.MAC, Dev: dev})
+		}
+	}
+	return objs
+}
@@ -0,0 +1,278 @@
+package reconcile
+
+import (
+	"container-network/fn/nl"
+	"container-network/network/firewall"
+	"fmt"
+)
+
+// Link is a link that is up and, if Master is set, enslaved to Master.
+// Add creates the link if it is missing, and tags it with Alias. A link in a
+// container netns is only brought up, it goes away with the netns.
+type Link struct {
+	Name   string
+	Netns  string
+	Master string
+	Add    func() error `json:"-"`
+}
+
+func (l *Link) Key() string {
+	return inNetns(l.Netns, "link "+l.Name)
+}
+
+func (l *Link) Observe() (bool, error) {
+	if len(l.Netns) > 0 {
+		return nl.InNetns(l.Netns).IsLinkUp(l.Name)
+	}
+	up, err := nl.IsLinkUp(l.Name)
+	if err != nil || !up || len(l.Master) == 0 {
+		return up, err
+	}
+	master, err := nl.LinkMaster(l.Name)
+	if err != nil {
+		return false, err
+	}
+	return master == l.Master, nil
+}
+
+func (l *Link) Create() error {
+	if len(l.Netns) > 0 {
+		return nl.InNetns(l.Netns).SetLinkUp(l.Name)
+	}
+	if l.Add != nil && !nl.LinkExists(l.Name) {
+		if err := l.Add(); err != nil && !nl.IsExist(err) {
+			return err
+		}
+		if err := TagLink(l.Name); err != nil {
+			return err
+		}
+	}
+	if len(l.Master) > 0 {
+		if err := nl.SetLinkMaster(l.Name, l.Master); err != nil {
+			return err
+		}
+	}
+	return nl.SetLinkUp(l.Name)
+}
+
+func (l *Link) Exists() (bool, error) {
+	if len(l.Netns) > 0 {
+		return true, nil
+	}
+	return nl.LinkExists(l.Name), nil
+}
+
+func (l *Link) Tagged() (bool, error) {
+	if len(l.Netns) > 0 {
+		return false, nil
+	}
+	return OwnsLink(l.Name)
+}
+
+func (l *Link) Delete() error {
+	if len(l.Netns) > 0 {
+		return nil
+	}
+	if err := nl.DelLink(l.Name); err != nil && !nl.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Addr is an address of Dev, with a prefix, e.g. 172.18.10.1/24.
+type Addr struct {
+	Dev   string
+	Addr  string
+	NoDAD bool
+	Netns string
+}
+
+func (a *Addr) Key() string {
+	return inNetns(a.Netns, fmt.Sprintf("addr %v dev %v", a.Addr, a.Dev))
+}
+
+func (a *Addr) Observe() (bool, error) {
+	if len(a.Netns) > 0 {
+		return nl.InNetns(a.Netns).HasAddr(a.Dev, a.Addr)
+	}
+	return nl.HasAddr(a.Dev, a.Addr)
+}
+
+func (a *Addr) Create() error {
+	var err error
+	if len(a.Netns) > 0 {
+		err = nl.InNetns(a.Netns).AddAddr(a.Dev, a.Addr, a.NoDAD)
+	} else {
+		err = nl.AddAddr(a.Dev, a.Addr, a.NoDAD)
+	}
+	if err != nil && !nl.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (a *Addr) Delete() error {
+	var err error
+	if len(a.Netns) > 0 {
+		err = nl.InNetns(a.Netns).DelAddr(a.Dev, a.Addr)
+	} else {
+		err = nl.DelAddr(a.Dev, a.Addr)
+	}
+	if err != nil && !nl.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Route is a route of the main table. A route to the same destination
+// through another gateway or device is replaced.
+type Route struct {
+	nl.Route
+	Netns string
+}
+
+func (r *Route) Key() string {
+	return inNetns(r.Netns, "route "+r.Route.String())
+}
+
+func (r *Route) Observe() (bool, error) {
+	if len(r.Netns) > 0 {
+		return nl.InNetns(r.Netns).HasRoute(r.Route)
+	}
+	return nl.HasRoute(r.Route)
+}
+
+func (r *Route) Create() error {
+	if len(r.Netns) > 0 {
+		return nl.InNetns(r.Netns).ReplaceRoute(r.Route)
+	}
+	return nl.ReplaceRoute(r.Route)
+}
+
+func (r *Route) Delete() error {
+	var err error
+	if len(r.Netns) > 0 {
+		err = nl.InNetns(r.Netns).DelRoute(r.Route)
+	} else {
+		err = nl.DelRoute(r.Route)
+	}
+	if err != nil && !nl.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Neigh is a permanent neighbor entry. Its key leaves out the MAC, so a new
+// MAC replaces the entry instead of adding a second one.
+type Neigh struct {
+	IP  string
+	MAC string
+	Dev string
+}
+
+func (n *Neigh) Key() string {
+	return fmt.Sprintf("neigh %v dev %v", n.IP, n.Dev)
+}
+
+func (n *Neigh) Observe() (bool, error) {
+	return nl.HasNeigh(n.IP, n.MAC, n.Dev)
+}
+
+func (n *Neigh) Create() error {
+	return nl.ReplaceNeigh(n.IP, n.MAC, n.Dev)
+}
+
+func (n *Neigh) Delete() error {
+	if err := nl.DelNeigh(n.IP, n.Dev); err != nil && !nl.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// FDB forwards frames for MAC on the vxlan device Dev to the node Dst.
+type FDB struct {
+	MAC string
+	Dev string
+	Dst string
+}
+
+func (f *FDB) Key() string {
+	return fmt.Sprintf("fdb %v dev %v dst %v", f.MAC, f.Dev, f.Dst)
+}
+
+func (f *FDB) Observe() (bool, error) {
+	return nl.HasFDB(f.MAC, f.Dev, f.Dst)
+}
+
+func (f *FDB) Create() error {
+	if err := nl.AppendFDB(f.MAC, f.Dev, f.Dst); err != nil && !nl.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *FDB) Delete() error {
+	if err := nl.DelFDB(f.MAC, f.Dev, f.Dst); err != nil && !nl.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sysctl is a kernel parameter. Deleting it leaves the value in place, other
+// software may rely on it too.
+type Sysctl struct {
+	Name  string
+	Value string
+}
+
+func (s *Sysctl) Key() string {
+	return fmt.Sprintf("sysctl %v", s.Name)
+}
+
+func (s *Sysctl) Observe() (bool, error) {
+	value, err := nl.ReadSysctl(s.Name)
+	return value == s.Value, err
+}
+
+func (s *Sysctl) Create() error {
+	return nl.Sysctl(s.Name, s.Value)
+}
+
+func (s *Sysctl) Delete() error {
+	return nil
+}
+
+// Firewall is the whole rule set of the node, it is installed at once.
+type Firewall struct {
+	Firewall firewall.Firewall `json:"-"`
+	Rules    *firewall.Rules
+}
+
+func (f *Firewall) Key() string {
+	return "firewall"
+}
+
+func (f *Firewall) Observe() (bool, error) {
+	return f.Firewall.Installed(f.Rules)
+}
+
+func (f *Firewall) Create() error {
+	return f.Firewall.Apply(f.Rules)
+}
+
+// Tagged is always true. Every rule carries the daemon's comment or lives in
+// its own table, so Remove never touches other rules.
+func (f *Firewall) Tagged() (bool, error) {
+	return true, nil
+}
+
+func (f *Firewall) Delete() error {
+	return f.Firewall.Remove(f.Rules)
+}
+
+func inNetns(netns string, key string) string {
+	if len(netns) == 0 {
+		return key
+	}
+	return fmt.Sprintf("netns %v %v", netns, key)
+}
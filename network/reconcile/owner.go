@@ -0,0 +1,196 @@
+package reconcile
+
+import (
+	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/firewall"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Alias tags the links the daemon creates.
+const Alias = "container-network"
+
+// TagLink tags a link the daemon created outside of a Link object.
+func TagLink(name string) error {
+	return nl.SetLinkAlias(name, Alias)
+}
+
+// OwnsLink reports whether the link carries the daemon's tag. A missing link
+// is not owned.
+func OwnsLink(name string) (bool, error) {
+	alias, err := nl.LinkAlias(name)
+	if nl.IsNotExist(err) {
+		return false, nil
+	}
+	return alias == Alias, err
+}
+
+// Existing is implemented by objects that can exist in another state than
+// the described one, e.g. a link that is down. The reconciler only owns an
+// object it created, not one it merely brought into the described state.
+type Existing interface {
+	Exists() (bool, error)
+}
+
+// Tagged is implemented by objects that carry a tag of the daemon in the
+// kernel, e.g. a link alias. A tagged object is owned even if its record is lost.
+type Tagged interface {
+	Tagged() (bool, error)
+}
+
+// Record is an object the daemon created. It holds the object itself, so the
+// object can be removed after a restart that no longer desires it.
+type Record struct {
+	Key     string          `json:"key"`
+	Kind    string          `json:"kind"`
+	Object  json.RawMessage `json:"object"`
+	Created time.Time       `json:"created"`
+}
+
+// Decode returns the recorded object.
+func (r *Record) Decode() (Object, error) {
+	var obj Object
+	switch r.Kind {
+	case "link":
+		obj = &Link{}
+	case "addr":
+		obj = &Addr{}
+	case "route":
+		obj = &Route{}
+	case "neigh":
+		obj = &Neigh{}
+	case "fdb":
+		obj = &FDB{}
+	case "sysctl":
+		obj = &Sysctl{}
+	case "firewall":
+		fw, err := firewall.New()
+		if err != nil {
+			return nil, err
+		}
+		obj = &Firewall{Firewall: fw}
+	default:
+		return nil, fmt.Errorf("unknown kind: %v. key: %v", r.Kind, r.Key)
+	}
+	if err := json.Unmarshal(r.Object, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func kind(obj Object) string {
+	switch obj.(type) {
+	case *Link:
+		return "link"
+	case *Addr:
+		return "addr"
+	case *Route:
+		return "route"
+	case *Neigh:
+		return "neigh"
+	case *FDB:
+		return "fdb"
+	case *Sysctl:
+		return "sysctl"
+	case *Firewall:
+		return "firewall"
+	}
+	return fmt.Sprintf("%T", obj)
+}
+
+// NewOwner loads the records persisted at path. An empty path keeps them
+// in memory only.
+func NewOwner(path string) (*Owner, error) {
+	o := &Owner{path: path, records: map[string]*Record{}}
+	if len(path) == 0 {
+		return o, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := []*Record{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		o.records[record.Key] = record
+	}
+	return o, nil
+}
+
+// Owner records the objects the daemon created, so that removing objects
+// never tears down host networking that was there before it.
+type Owner struct {
+	path    string
+	records map[string]*Record
+	sync.Mutex
+}
+
+func (o *Owner) Owns(key string) bool {
+	o.Lock()
+	defer o.Unlock()
+	_, ok := o.records[key]
+	return ok
+}
+
+func (o *Owner) Add(obj Object) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	o.Lock()
+	defer o.Unlock()
+	created := time.Now()
+	if record, ok := o.records[obj.Key()]; ok {
+		created = record.Created
+	}
+	o.records[obj.Key()] = &Record{Key: obj.Key(), Kind: kind(obj), Object: data, Created: created}
+	return o.save()
+}
+
+func (o *Owner) Remove(key string) error {
+	o.Lock()
+	defer o.Unlock()
+	if _, ok := o.records[key]; !ok {
+		return nil
+	}
+	delete(o.records, key)
+	return o.save()
+}
+
+// Records returns the records sorted by key.
+func (o *Owner) Records() []*Record {
+	o.Lock()
+	defer o.Unlock()
+	return o.sorted()
+}
+
+func (o *Owner) sorted() []*Record {
+	records := make([]*Record, 0, len(o.records))
+	for _, record := range o.records {
+		r := *record
+		records = append(records, &r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+func (o *Owner) save() error {
+	if len(o.path) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(o.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return fn.WriteFileAtomic(o.path, data)
+}
@@ -0,0 +1,238 @@
+package reconcile
+
+import (
+	"container-network/fn"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Object is one piece of host state, e.g. a link, an address or a route.
+type Object interface {
+	// Key identifies the object across passes. Two objects with the same key
+	// describe the same kernel object, possibly in different states.
+	Key() string
+	// Observe reports whether the kernel object is in the described state.
+	Observe() (bool, error)
+	// Create brings the kernel object into the described state. It may find
+	// the object partly in place.
+	Create() error
+	// Delete removes the kernel object. It may find the object already gone.
+	Delete() error
+}
+
+type State string
+
+const (
+	InSync  State = "in-sync"
+	Created State = "created"
+	Deleted State = "deleted"
+	// Released objects are no longer desired but were left in place, since
+	// the daemon did not create them.
+	Released State = "released"
+	Failed   State = "failed"
+)
+
+// Status is the outcome of the last pass over an object.
+type Status struct {
+	Key     string    `json:"key"`
+	State   State     `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func New(owner *Owner) *Reconciler {
+	return &Reconciler{
+		owner:     owner,
+		installed: map[string]Object{},
+		status:    map[string]*Status{},
+	}
+}
+
+// Reconciler keeps the host in the desired state. It creates the desired
+// objects the kernel is missing and deletes the objects it installed that
+// are no longer desired. Objects already in place are adopted, so a restart
+// does not touch a configured host. Only the objects the owner records as
+// created by the daemon, or that carry its tag, are ever deleted.
+type Reconciler struct {
+	owner *Owner
+	// installed holds the objects created or adopted, keyed by Key.
+	installed map[string]Object
+	// order holds the keys of installed in the order they were installed.
+	// Objects are deleted in reverse order, e.g. routes before their link.
+	order  []string
+	status map[string]*Status
+	sync.Mutex
+}
+
+// Reconcile brings the host in line with the objects returned by desired.
+// desired is called with the reconciler locked, so an object that Ensure
+// installs concurrently is either part of it or installed after the pass.
+func (r *Reconciler) Reconcile(desired func() []Object) {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, status := range r.status {
+		if status.State == Deleted || status.State == Released {
+			delete(r.status, key)
+		}
+	}
+
+	keys := map[string]struct{}{}
+	for _, obj := range desired() {
+		keys[obj.Key()] = struct{}{}
+		r.ensure(obj)
+	}
+	for i := len(r.order) - 1; i >= 0; i-- {
+		key := r.order[i]
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		r.remove(r.installed[key])
+	}
+	// Objects that failed before being installed are forgotten once they are
+	// no longer desired.
+	for key, status := range r.status {
+		_, desired := keys[key]
+		_, installed := r.installed[key]
+		if !desired && !installed && status.State == Failed {
+			delete(r.status, key)
+		}
+	}
+}
+
+// Ensure creates the objects the kernel is missing, in order, and returns
+// the first failure.
+func (r *Reconciler) Ensure(objs []Object) error {
+	r.Lock()
+	defer r.Unlock()
+	var first error
+	for _, obj := range objs {
+		if err := r.ensure(obj); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Remove deletes the objects, in reverse order, and returns the first failure.
+func (r *Reconciler) Remove(objs []Object) error {
+	r.Lock()
+	defer r.Unlock()
+	var first error
+	for i := len(objs) - 1; i >= 0; i-- {
+		if err := r.remove(objs[i]); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Status returns the status of every object, sorted by key.
+func (r *Reconciler) Status() []*Status {
+	r.Lock()
+	defer r.Unlock()
+	statuses := make([]*Status, 0, len(r.status))
+	for _, status := range r.status {
+		s := *status
+		statuses = append(statuses, &s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+	return statuses
+}
+
+func (r *Reconciler) ensure(obj Object) error {
+	key := obj.Key()
+	ok, err := obj.Observe()
+	if err != nil {
+		r.fail(key, "observe", err)
+		return err
+	}
+	// The latest description replaces the installed one, so Delete removes
+	// what is in place now.
+	if _, installed := r.installed[key]; !installed {
+		r.order = append(r.order, key)
+	}
+	r.installed[key] = obj
+	if ok {
+		r.set(key, InSync, nil)
+		return nil
+	}
+	existed := false
+	if e, ok := obj.(Existing); ok {
+		if existed, err = e.Exists(); err != nil {
+			r.fail(key, "observe", err)
+			return err
+		}
+	}
+	if err := obj.Create(); err != nil {
+		r.fail(key, "create", err)
+		return err
+	}
+	if !existed {
+		if err := r.owner.Add(obj); err != nil {
+			fn.Errorf("failed to record %v. error: %v", key, err)
+		}
+	}
+	fn.Infof("created %v", key)
+	r.set(key, Created, nil)
+	return nil
+}
+
+func (r *Reconciler) remove(obj Object) error {
+	key := obj.Key()
+	owned, err := r.owns(obj)
+	if err != nil {
+		r.fail(key, "observe", err)
+		return err
+	}
+	if owned {
+		if err := obj.Delete(); err != nil {
+			r.fail(key, "delete", err)
+			return err
+		}
+		if err := r.owner.Remove(key); err != nil {
+			fn.Errorf("failed to forget %v. error: %v", key, err)
+		}
+	}
+	if _, installed := r.installed[key]; installed {
+		delete(r.installed, key)
+		for i, k := range r.order {
+			if k == key {
+				r.order = append(r.order[:i], r.order[i+1:]...)
+				break
+			}
+		}
+	}
+	if !owned {
+		fn.Infof("released %v", key)
+		r.set(key, Released, nil)
+		return nil
+	}
+	fn.Infof("deleted %v", key)
+	r.set(key, Deleted, nil)
+	return nil
+}
+
+func (r *Reconciler) owns(obj Object) (bool, error) {
+	if r.owner.Owns(obj.Key()) {
+		return true, nil
+	}
+	if t, ok := obj.(Tagged); ok {
+		return t.Tagged()
+	}
+	return false, nil
+}
+
+func (r *Reconciler) fail(key string, op string, err error) {
+	fn.Errorf("failed to %v %v. error: %v", op, key, err)
+	r.set(key, Failed, err)
+}
+
+func (r *Reconciler) set(key string, state State, err error) {
+	status := &Status{Key: key, State: state, Updated: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	r.status[key] = status
+}
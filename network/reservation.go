@@ -0,0 +1,52 @@
+package network
+
+import (
+	"container-network/cluster"
+	"container-network/network/ipam"
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleReservations registers the reservation endpoints on the local
+// socket, so only the node itself pins addresses.
+func (m *Mgr) handleReservations() {
+	cluster.Instance.HandleLocal("GET", "/ipam/reservations", m.listReservations)
+	cluster.Instance.HandleLocal("POST", "/ipam/reservations", m.reserve)
+	cluster.Instance.HandleLocal("DELETE", "/ipam/reservations", m.unreserve)
+}
+
+func (m *Mgr) listReservations(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	bys, err := json.Marshal(ipam.Instance.Reservations())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(bys)
+}
+
+// reserve adds the reservation in the body. It applies to containers that
+// have no lease yet.
+func (m *Mgr) reserve(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	reservation := &cluster.Reservation{}
+	if err := json.NewDecoder(r.Body).Decode(reservation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ipam.Instance.Reserve(reservation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *Mgr) unreserve(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	query := r.URL.Query()
+	if err := ipam.Instance.Unreserve(query.Get("network"), query.Get("container")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
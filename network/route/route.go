@@ -0,0 +1,59 @@
+package route
+
+import (
+	"container-network/cluster"
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
+	"context"
+	"fmt"
+)
+
+func init() {
+	driver.Register("route", func() driver.Driver { return New() })
+}
+
+func New() *Route {
+	return &Route{}
+}
+
+// Route is the host-gateway mode: every node's container CIDR is reached
+// directly via the node IP, so all nodes must share an L2 segment.
+type Route struct {
+	driver.Peers
+}
+
+func (r *Route) Init() error {
+	if err := nl.Sysctl("net.ipv4.conf.all.forwarding", "1"); err != nil {
+		return fmt.Errorf("failed to set net.ipv4.conf.all.forwarding=1: %s", err)
+	}
+	return nil
+}
+
+func (r *Route) Reconcile(ctx context.Context) error {
+	return nil
+}
+
+// Desired returns the route to the CIDR of every peer. The routes are IPv4
+// only, so an IPv6-only peer gets none.
+func (r *Route) Desired() []reconcile.Object {
+	objs := []reconcile.Object{}
+	for _, node := range r.Nodes() {
+		if len(node.Container.CIDR) == 0 {
+			continue
+		}
+		objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: node.Container.CIDR, Via: node.IP, Dev: cluster.Instance.Current.Interface}})
+	}
+	return objs
+}
+
+// Scope is empty, the node interface carries routes of others too.
+func (r *Route) Scope() reconcile.Scope {
+	return reconcile.Scope{}
+}
+
+// Cleanup has nothing left to do, Mgr has already removed the objects of
+// Desired.
+func (r *Route) Cleanup() error {
+	return nil
+}
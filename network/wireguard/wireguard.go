@@ -0,0 +1,220 @@
+package wireguard
+
+import (
+	"container-network/cluster"
+	"container-network/fn"
+	"container-network/fn/nl"
+	"container-network/network/driver"
+	"container-network/network/reconcile"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	driver.Register("wireguard", func() driver.Driver { return New() })
+}
+
+func New() *WireGuard {
+	// --wg-key-path=<path> overrides where the private key is kept.
+	keyPath := fn.Args("wg-key-path")
+	if len(keyPath) == 0 {
+		keyPath = filepath.Join(fn.StateDir, "wireguard.key")
+	}
+	return &WireGuard{
+		wg0:     "wg0",
+		keyPath: keyPath,
+		keys:    map[string]string{},
+	}
+}
+
+// WireGuard encrypts cross-node container traffic. Each peer is configured
+// with its container CIDR as AllowedIPs and its node IP as Endpoint.
+type WireGuard struct {
+	driver.Peers
+	wg0     string
+	keyPath string
+	// keys holds the public key configured for each peer, keyed by node IP.
+	keys map[string]string
+}
+
+func (w *WireGuard) Init() error {
+	publicKey, err := w.loadKey()
+	if err != nil {
+		return err
+	}
+
+	if err := nl.AddWireGuard(w.wg0); err == nil {
+		if err := reconcile.TagLink(w.wg0); err != nil {
+			return fmt.Errorf("failed to tag wg0. error: %v", err)
+		}
+	} else if !nl.IsExist(err) {
+		return fmt.Errorf("failed to create wg0. error: %v", err)
+	}
+	if err := w.configure(); err != nil {
+		return err
+	}
+
+	if err := nl.SetLinkUp(w.wg0); err != nil {
+		return fmt.Errorf("failed to set wg0 up. error: %v", err)
+	}
+
+	if cluster.Instance.Current.WireGuard == nil {
+		cluster.Instance.Current.WireGuard = &cluster.WireGuard{}
+	}
+	cluster.Instance.Current.WireGuard.PublicKey = publicKey
+	return nil
+}
+
+// add creates wg0 again with the private key of the node, for the reconciler
+// if wg0 goes away. Reconcile configures the peers again.
+func (w *WireGuard) add() error {
+	if err := nl.AddWireGuard(w.wg0); err != nil {
+		return err
+	}
+	return w.configure()
+}
+
+func (w *WireGuard) configure() error {
+	cmdout, err := fn.Exec.Run("wg", "set", w.wg0, "listen-port", fmt.Sprint(listenPort(cluster.Instance.Current)), "private-key", w.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to set wg0 private key. cmdout: %s. error: %v", cmdout, err)
+	}
+	return nil
+}
+
+// loadKey reads the private key from keyPath, generating a new one on first
+// start, and returns the matching public key. The new key is written through
+// the executor, so a dry run keeps it in memory only.
+func (w *WireGuard) loadKey() (string, error) {
+	data, err := os.ReadFile(w.keyPath)
+	if os.IsNotExist(err) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate wireguard private key: %v", err)
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(key.Bytes()) + "\n")
+		err = fn.Exec.Apply(fmt.Sprintf("# write a new wireguard private key to %v", w.keyPath), func() error {
+			if err := os.MkdirAll(filepath.Dir(w.keyPath), 0700); err != nil {
+				return err
+			}
+			return fn.WriteFileAtomic(w.keyPath, data)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to write wireguard private key. path: %v. error: %v", w.keyPath, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read wireguard private key. path: %v. error: %v", w.keyPath, err)
+	}
+
+	// The public key is the X25519 public key of the private key, as with
+	// wg pubkey.
+	bys, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid wireguard private key. path: %v. error: %v", w.keyPath, err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(bys)
+	if err != nil {
+		return "", fmt.Errorf("invalid wireguard private key. path: %v. error: %v", w.keyPath, err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// RemoveNode also removes the peer from wg0. Reconcile adds the peers.
+func (w *WireGuard) RemoveNode(node *cluster.Node) error {
+	if key, ok := w.keys[node.IP]; ok {
+		if err := w.removePeer(key); err != nil {
+			return err
+		}
+		delete(w.keys, node.IP)
+	}
+	return w.Peers.RemoveNode(node)
+}
+
+func (w *WireGuard) Reconcile(ctx context.Context) error {
+	for _, node := range w.Nodes() {
+		if err := w.setPeer(ctx, node); err != nil {
+			fn.Errorf("%v", err)
+		}
+	}
+	return nil
+}
+
+// Desired returns wg0 and the routes to the CIDRs of every peer through it.
+func (w *WireGuard) Desired() []reconcile.Object {
+	objs := []reconcile.Object{&reconcile.Link{Name: w.wg0, Add: w.add}}
+	for _, node := range w.Nodes() {
+		for _, cidr := range allowedIPs(node) {
+			objs = append(objs, &reconcile.Route{Route: nl.Route{Dst: cidr, Dev: w.wg0}})
+		}
+	}
+	return objs
+}
+
+// Scope has the collector look for the routes of departed peers on wg0.
+func (w *WireGuard) Scope() reconcile.Scope {
+	return reconcile.Scope{Devices: []string{w.wg0}}
+}
+
+// Cleanup deletes wg0, unless it was there before the daemon.
+func (w *WireGuard) Cleanup() error {
+	if owned, err := reconcile.OwnsLink(w.wg0); err != nil || !owned {
+		return err
+	}
+	if err := nl.DelLink(w.wg0); err != nil && !nl.IsNotExist(err) {
+		return fmt.Errorf("failed to delete wg0. error: %v", err)
+	}
+	return nil
+}
+
+func (w *WireGuard) setPeer(ctx context.Context, node *cluster.Node) error {
+	key, err := cluster.Instance.GetWireGuardPublicKey(ctx, node.IP)
+	if err != nil {
+		return fmt.Errorf("failed to get wireguard public key. node: %v. error: %v", node, err)
+	}
+	if old, ok := w.keys[node.IP]; ok && old != key {
+		if err := w.removePeer(old); err != nil {
+			return err
+		}
+	}
+
+	endpoint := net.JoinHostPort(node.IP, fmt.Sprint(listenPort(node)))
+	cmdout, err := fn.Exec.Run("wg", "set", w.wg0, "peer", key, "allowed-ips", strings.Join(allowedIPs(node), ","), "endpoint", endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to set wireguard peer. node: %v. cmdout: %s. error: %v", node, cmdout, err)
+	}
+	w.keys[node.IP] = key
+	return nil
+}
+
+// allowedIPs returns the container CIDRs of the peer.
+func allowedIPs(node *cluster.Node) []string {
+	cidrs := []string{}
+	for _, cidr := range []string{node.Container.CIDR, node.Container.CIDR6} {
+		if len(cidr) > 0 {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+func (w *WireGuard) removePeer(key string) error {
+	cmdout, err := fn.Exec.Run("wg", "set", w.wg0, "peer", key, "remove")
+	if err != nil {
+		return fmt.Errorf("failed to remove wireguard peer. key: %v. cmdout: %s. error: %v", key, cmdout, err)
+	}
+	return nil
+}
+
+func listenPort(node *cluster.Node) int {
+	if node.WireGuard != nil && node.WireGuard.ListenPort > 0 {
+		return node.WireGuard.ListenPort
+	}
+	return 51820
+}
@@ -0,0 +1,75 @@
+#!/bin/sh
+# Runs the daemon with --network=bgp against gobgpd in the bgp-peer netns and
+# checks that the prefix the peer announces is installed as a route, recorded
+# as owned in owned.json, put back after it is deleted, and removed on exit.
+# It needs root, gobgpd and gobgp, and changes the host: run it on a test
+# machine.
+set -eu
+
+cd "$(dirname "$0")"
+prefix=10.98.0.0/24
+state=/var/lib/container-network/owned.json
+tmp=$(mktemp -d)
+
+cleanup() {
+	[ -n "${daemon:-}" ] && kill "$daemon" 2>/dev/null && wait "$daemon" || true
+	ip netns pids bgp-peer 2>/dev/null | xargs -r kill
+	ip netns del bgp-peer 2>/dev/null || true
+	ip link del veth-bgp 2>/dev/null || true
+	rm -rf "$tmp"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $*" >&2
+	echo "daemon log:" >&2
+	cat "$tmp/daemon.log" >&2
+	exit 1
+}
+
+# waitfor runs the command until it succeeds, for up to $1 seconds.
+waitfor() {
+	timeout=$1
+	shift
+	while [ "$timeout" -gt 0 ]; do
+		if "$@" >/dev/null 2>&1; then
+			return 0
+		fi
+		sleep 1
+		timeout=$((timeout - 1))
+	done
+	return 1
+}
+
+learned() {
+	ip route show "$prefix" | grep -q "via 10.99.0.2"
+}
+
+go build -o "$tmp/container-network" ../..
+
+ip netns add bgp-peer
+ip link add veth-bgp type veth peer name veth-bgp-peer
+ip link set veth-bgp-peer netns bgp-peer
+ip addr add 10.99.0.1/24 dev veth-bgp && ip link set veth-bgp up
+ip netns exec bgp-peer ip addr add 10.99.0.2/24 dev veth-bgp-peer
+ip netns exec bgp-peer ip link set veth-bgp-peer up
+ip netns exec bgp-peer ip link set lo up
+ip netns exec bgp-peer gobgpd -f peer.toml >"$tmp/gobgpd.log" 2>&1 &
+
+"$tmp/container-network" --network=bgp --cfgPath=config.yaml >"$tmp/daemon.log" 2>&1 &
+daemon=$!
+
+waitfor 10 ip netns exec bgp-peer gobgp global rib add "$prefix" -a ipv4 || fail "gobgpd did not start"
+
+waitfor 60 learned || fail "route to $prefix not learned"
+grep -q "route $prefix via 10.99.0.2" "$state" || fail "route to $prefix not recorded in $state"
+
+ip route del "$prefix"
+waitfor 10 learned || fail "route to $prefix not put back"
+
+kill "$daemon"
+wait "$daemon" || true
+daemon=
+learned && fail "route to $prefix left behind on exit"
+
+echo PASS